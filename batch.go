@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/dnstrace/client"
+)
+
+// runBatch traces the queries read from path, one [qtype...] <domain> per
+// line, and returns the exit code of the last failed trace. Empty lines and
+// lines starting with # are ignored. If failFast is true, it returns at the
+// first failure.
+func runBatch(ctx context.Context, c *client.Client, path string, failFast bool, o options) int {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	exitCode, names, failed := 0, 0, 0
+	s := bufio.NewScanner(in)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if names > 0 {
+			fmt.Println()
+		}
+		names++
+		fmt.Println(o.col(";;; "+line, client.ColorBold))
+		fmt.Println()
+		code := 1
+		if qname, qtypes, err := parseArgs(strings.Fields(line)); err != nil {
+			if err == errUsage {
+				err = fmt.Errorf("expected [qtype...] <domain>")
+			}
+			fmt.Printf(o.col("*** error: line %d: %v\n", client.ColorRed), lineno, err)
+		} else {
+			code = traceName(ctx, c, qname, qtypes, o)
+		}
+		if code != 0 {
+			exitCode = code
+			failed++
+			if failFast {
+				fmt.Println(o.col("\n(stopped at the first failure)", client.ColorYellow))
+				return exitCode
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+		return 1
+	}
+	fmt.Println()
+	fmt.Printf(o.col(";; Batch: %d name(s), %d failed\n", client.ColorGray), names, failed)
+	return exitCode
+}
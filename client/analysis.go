@@ -0,0 +1,535 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NSComparison compares the NS set of a zone delegated by its parent with the
+// NS set returned by the zone's own servers.
+type NSComparison struct {
+	Zone       string
+	Parent     []string
+	Child      []string
+	ParentOnly []string
+	ChildOnly  []string
+}
+
+// Match returns true if parent and child NS sets are identical.
+func (nc NSComparison) Match() bool {
+	return len(nc.ParentOnly) == 0 && len(nc.ChildOnly) == 0
+}
+
+// CompareNS compares the NS set delegated to zone by its parent with the NS set
+// reported authoritatively by the zone's servers.
+func (c *Client) CompareNS(zone string) (NSComparison, error) {
+	zone = dns.Fqdn(zone)
+	nc := NSComparison{Zone: zone}
+	servers, err := c.AuthoritativeNS(zone)
+	if err != nil {
+		return nc, err
+	}
+	for _, s := range servers {
+		nc.Parent = append(nc.Parent, strings.ToLower(s.Name))
+	}
+	m := &dns.Msg{}
+	m.SetQuestion(zone, dns.TypeNS)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	fr := c.ParallelQuery(m, servers).Fastest()
+	if fr.Msg == nil {
+		if fr.Err != nil {
+			return nc, fr.Err
+		}
+		return nc, errors.New("no response")
+	}
+	for _, rr := range fr.Msg.Answer {
+		if ns, ok := rr.(*dns.NS); ok && domainEqual(ns.Header().Name, zone) {
+			nc.Child = append(nc.Child, strings.ToLower(ns.Ns))
+		}
+	}
+	sort.Strings(nc.Parent)
+	sort.Strings(nc.Child)
+	nc.ParentOnly = difference(nc.Parent, nc.Child)
+	nc.ChildOnly = difference(nc.Child, nc.Parent)
+	return nc, nil
+}
+
+// difference returns the elements of a not in b.
+func difference(a, b []string) (d []string) {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	for _, s := range a {
+		if !in[s] {
+			d = append(d, s)
+		}
+	}
+	return d
+}
+
+// Redundancy describes how the name servers of a zone are spread over the
+// network.
+type Redundancy struct {
+	Zone    string
+	Servers int
+	// SameIP is true if all the name servers share the same address(es).
+	SameIP bool
+	// SamePrefix is true if all the addresses of the name servers are within
+	// the same /24 (IPv4) and /48 (IPv6) prefixes.
+	SamePrefix bool
+	// Prefixes4 and Prefixes6 are the number of distinct /24 (IPv4) and /48
+	// (IPv6) prefixes of the addresses of the name servers.
+	Prefixes4, Prefixes6 int
+}
+
+// Redundancy scores.
+const (
+	RedundancyPoor = "poor"
+	RedundancyFair = "fair"
+	RedundancyGood = "good"
+)
+
+// Score rates the redundancy of the zone: poor for a single point of failure,
+// good for at least 3 distinct prefixes over both IP families and fair
+// otherwise.
+func (rd Redundancy) Score() string {
+	switch {
+	case rd.SinglePointOfFailure():
+		return RedundancyPoor
+	case rd.Prefixes4+rd.Prefixes6 >= 3 && rd.Prefixes4 > 0 && rd.Prefixes6 > 0:
+		return RedundancyGood
+	default:
+		return RedundancyFair
+	}
+}
+
+// SinglePointOfFailure returns true if the zone depends on a single server
+// or network.
+func (rd Redundancy) SinglePointOfFailure() bool {
+	return rd.Servers < 2 || rd.SameIP || rd.SamePrefix
+}
+
+// CheckRedundancy groups the addresses of servers, the name servers of zone,
+// by IP and network prefix. Name servers must have been resolved.
+func CheckRedundancy(zone string, servers []Server) Redundancy {
+	rd := Redundancy{Zone: zone, Servers: len(servers)}
+	// Distinct IPs and prefixes per family.
+	ips := map[int]map[string]bool{4: {}, 6: {}}
+	prefixes := map[int]map[string]bool{4: {}, 6: {}}
+	// Whether some server only has IPv4, only IPv6 or both.
+	var only4, only6, dual bool
+	for _, s := range servers {
+		var has4, has6 bool
+		for _, addr := range s.Addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			family := 6
+			if ip.To4() != nil {
+				family = 4
+				has4 = true
+			} else {
+				has6 = true
+			}
+			ips[family][ip.String()] = true
+			prefixes[family][addrPrefix(ip)] = true
+		}
+		only4 = only4 || has4 && !has6
+		only6 = only6 || has6 && !has4
+		dual = dual || has4 && has6
+	}
+	// Servers of different families share nothing unless one has both.
+	split := only4 && only6 && !dual
+	rd.Prefixes4, rd.Prefixes6 = len(prefixes[4]), len(prefixes[6])
+	rd.SameIP = !split && singlePerFamily(ips)
+	rd.SamePrefix = !split && singlePerFamily(prefixes)
+	return rd
+}
+
+// singlePerFamily returns true if at least one family has values and every
+// family with values has a single one.
+func singlePerFamily(values map[int]map[string]bool) bool {
+	found := false
+	for _, v := range values {
+		if len(v) > 1 {
+			return false
+		}
+		found = found || len(v) == 1
+	}
+	return found
+}
+
+// addrPrefix returns the /24 (IPv4) or /48 (IPv6) network of ip.
+func addrPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// ResponseHash returns a short hash of the rcode, answer and authority
+// sections of r, ignoring record order, TTLs and name case, so responses with
+// the same content get the same hash. It returns an empty string if r is nil.
+func ResponseHash(r *dns.Msg) string {
+	if r == nil {
+		return ""
+	}
+	rrs := make([]string, 0, len(r.Answer)+len(r.Ns))
+	for i, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = 0
+			rrs = append(rrs, string(rune('0'+i))+strings.ToLower(rr.String()))
+		}
+	}
+	sort.Strings(rrs)
+	h := sha256.New()
+	h.Write([]byte(dns.RcodeToString[r.Rcode]))
+	for _, rr := range rrs {
+		h.Write([]byte{'\n'})
+		h.Write([]byte(rr))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+// EDNSIssue describes how the EDNS support of response r differs from query q:
+// missing OPT record (EDNS downgrade), BADVERS rcode or a different EDNS
+// version. It returns an empty string if there is no issue or q has no OPT.
+func EDNSIssue(q, r *dns.Msg) string {
+	qopt := q.IsEdns0()
+	if qopt == nil || r == nil {
+		return ""
+	}
+	ropt := r.IsEdns0()
+	switch {
+	case r.Rcode == dns.RcodeBadVers:
+		return "EDNS BADVERS"
+	case ropt == nil:
+		return "no EDNS"
+	case ropt.Version() != qopt.Version():
+		return fmt.Sprintf("EDNS version %d", ropt.Version())
+	default:
+		return ""
+	}
+}
+
+// Fingerprint holds the software version and host name reported by a server
+// address to CHAOS TXT queries. Empty values mean the server did not answer
+// them.
+type Fingerprint struct {
+	Server   string
+	Addr     string
+	Version  string
+	Hostname string
+}
+
+// Fingerprint queries each address of servers for CHAOS TXT version.bind and
+// hostname.bind. Results are in the order of servers and their addresses.
+func (c *Client) Fingerprint(servers []Server) []Fingerprint {
+	var fps []Fingerprint
+	index := map[string]int{}
+	for _, s := range servers {
+		for _, addr := range s.Addrs {
+			index[s.Name+" "+addr] = len(fps)
+			fps = append(fps, Fingerprint{Server: s.Name, Addr: addr})
+		}
+	}
+	for _, name := range []string{"version.bind.", "hostname.bind."} {
+		m := &dns.Msg{}
+		m.SetQuestion(name, dns.TypeTXT)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		m.RecursionDesired = false
+		for _, r := range c.ParallelQuery(m, servers) {
+			if r.Err != nil || r.Msg == nil || r.Msg.Rcode != dns.RcodeSuccess {
+				continue
+			}
+			var txt string
+			for _, rr := range r.Msg.Answer {
+				if t, ok := rr.(*dns.TXT); ok {
+					txt = strings.Join(t.Txt, "")
+					break
+				}
+			}
+			fp := &fps[index[r.Server.Name+" "+r.Addr]]
+			if name == "version.bind." {
+				fp.Version = txt
+			} else {
+				fp.Hostname = txt
+			}
+		}
+	}
+	return fps
+}
+
+// ResolvedName is a name an address resolves to and whether the name resolves
+// back to the address (forward-confirmed reverse DNS).
+type ResolvedName struct {
+	Name      string
+	Confirmed bool
+}
+
+// ResolveAddr returns the names of the PTR records of ip.
+func (c *Client) ResolveAddr(ip net.IP) (names []string, err error) {
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	m := &dns.Msg{}
+	m.SetQuestion(arpa, dns.TypePTR)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	r, _, err := c.RecursiveQuery(m, Tracer{}) // nolint: exhaustruct
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s: %s", arpa, dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	return names, nil
+}
+
+// ForwardConfirm resolves the addresses of each of names and reports whether
+// ip is one of them.
+func (c *Client) ForwardConfirm(ip net.IP, names []string) []ResolvedName {
+	rns := make([]ResolvedName, 0, len(names))
+	for _, name := range names {
+		rn := ResolvedName{Name: name}
+		addrs, _ := c.LookupHost(name)
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(ip) {
+				rn.Confirmed = true
+				break
+			}
+		}
+		rns = append(rns, rn)
+	}
+	return rns
+}
+
+// AliasTargets returns the PTR names of the addresses of the A and AAAA
+// records owned by the apex of zone in answer, when they are outside of zone
+// and resolve back to the same address. Such apex addresses are likely the
+// flattened result of a provider-specific ALIAS or ANAME record rather than
+// addresses managed in the zone. PTR names not confirmed forward, like the
+// generic names of hosting providers, are ignored.
+func (c *Client) AliasTargets(zone string, answer []dns.RR) []string {
+	var targets []string
+	seen := map[string]bool{}
+	for _, rr := range answer {
+		if !domainEqual(rr.Header().Name, zone) {
+			continue
+		}
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		names, _ := c.ResolveAddr(ip)
+		var outside []string
+		for _, name := range names {
+			if !dns.IsSubDomain(zone, name) && !seen[strings.ToLower(name)] {
+				outside = append(outside, name)
+			}
+		}
+		for _, rn := range c.ForwardConfirm(ip, outside) {
+			if rn.Confirmed {
+				seen[strings.ToLower(rn.Name)] = true
+				targets = append(targets, rn.Name)
+			}
+		}
+	}
+	return targets
+}
+
+// LameServers queries the SOA of zone on each address of servers and returns
+// the responses of the lame ones: failing, not answering NOERROR or not
+// authoritative for zone.
+func (c *Client) LameServers(zone string, servers []Server) Responses {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	m.RecursionDesired = false
+	var lame Responses
+	for _, r := range c.ParallelQuery(m, servers) {
+		if r.Err != nil || r.Msg.Rcode != dns.RcodeSuccess || !r.Msg.Authoritative {
+			lame = append(lame, r)
+		}
+	}
+	return lame
+}
+
+// PortStats describes the distribution of the source ports of a set of
+// queries.
+type PortStats struct {
+	Queries  int
+	Distinct int
+	Min, Max int
+	// Buckets counts the ports in each eighth of the 0-65535 range.
+	Buckets [8]int
+}
+
+// Randomized returns true if no port was reused and ports spread over more
+// than a thousand values, as expected from a source port randomizing stack
+// (RFC 5452).
+func (ps PortStats) Randomized() bool {
+	if ps.Queries < 2 {
+		return true
+	}
+	return ps.Distinct == ps.Queries && ps.Max-ps.Min > 1000
+}
+
+// SourcePorts returns the distribution of the source ports of steps. Responses
+// with an unknown source port are ignored.
+func SourcePorts(steps ...Responses) PortStats {
+	var ps PortStats
+	seen := map[int]bool{}
+	for _, rs := range steps {
+		for _, r := range rs {
+			if r.LocalPort == 0 {
+				continue
+			}
+			if ps.Queries == 0 || r.LocalPort < ps.Min {
+				ps.Min = r.LocalPort
+			}
+			if r.LocalPort > ps.Max {
+				ps.Max = r.LocalPort
+			}
+			ps.Queries++
+			ps.Buckets[r.LocalPort/8192]++
+			seen[r.LocalPort] = true
+		}
+	}
+	ps.Distinct = len(seen)
+	return ps
+}
+
+// ENTEvidence returns a name known to exist below qname, either from the NSEC
+// records of the NXDOMAIN response r or from the delegation cache. Such a name
+// makes qname an empty non-terminal, which must be answered with NOERROR and
+// no data (RFC 8020), so the NXDOMAIN is likely a server bug. It returns "" if
+// r is not an NXDOMAIN or no name below qname is known.
+func (c *Client) ENTEvidence(qname string, r *dns.Msg) string {
+	if r == nil || r.Rcode != dns.RcodeNameError {
+		return ""
+	}
+	below := func(name string) bool {
+		return !domainEqual(name, qname) && dns.IsSubDomain(qname, name)
+	}
+	for _, rr := range r.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			if below(nsec.Hdr.Name) {
+				return nsec.Hdr.Name
+			}
+			if below(nsec.NextDomain) {
+				return nsec.NextDomain
+			}
+		}
+	}
+	return c.DCache.Below(qname)
+}
+
+// ReferralViolations returns the ways the referral r from a server of zone
+// departs from RFC 1034 and RFC 9471: the AA bit is set, the answer section is
+// not empty or in-bailiwick name servers come without glue. It returns nil if
+// r is not a referral to a zone below zone.
+func ReferralViolations(r *dns.Msg, zone string) []string {
+	if r == nil {
+		return nil
+	}
+	child, servers := ParseDelegation(r)
+	if child == "" || domainEqual(child, zone) || !dns.IsSubDomain(zone, child) {
+		return nil
+	}
+	var vs []string
+	if r.Authoritative {
+		vs = append(vs, "AA bit set on a referral")
+	}
+	if len(r.Answer) > 0 {
+		vs = append(vs, fmt.Sprintf("%d record(s) in the answer section of a referral", len(r.Answer)))
+	}
+	for _, s := range servers {
+		if s.NeedsGlue(child) && !s.HasGlue {
+			vs = append(vs, fmt.Sprintf("no glue for in-bailiwick name server %s", s.Name))
+		}
+	}
+	return vs
+}
+
+// GlueMismatch is a name server whose glue addresses differ from the addresses
+// served by its authoritative zone, for the families present in the glue.
+type GlueMismatch struct {
+	Zone          string
+	Server        string
+	Glue          []string
+	Authoritative []string
+}
+
+// CheckGlue resolves the addresses of the servers of zone delegated with glue
+// from their authoritative zone, bypassing LCache which holds the glue, and
+// returns the servers whose glue is stale. Families missing from the glue or
+// failing to resolve are not compared.
+func (c *Client) CheckGlue(zone string, servers []Server) []GlueMismatch {
+	var mismatches []GlueMismatch
+	for _, s := range servers {
+		if !s.HasGlue {
+			continue
+		}
+		var auth []string
+		differ := false
+		for _, qtype := range c.addrTypes() {
+			glue := familyOf(s.Addrs, qtype)
+			if len(glue) == 0 {
+				continue
+			}
+			m := &dns.Msg{}
+			m.SetQuestion(dns.Fqdn(s.Name), qtype)
+			m.SetEdns0(dns.DefaultMsgSize, true)
+			r, _, err := c.RecursiveQuery(m, Tracer{})
+			if err != nil || r == nil || r.Rcode != dns.RcodeSuccess {
+				continue
+			}
+			addrs := answerAddrs(r)
+			auth = append(auth, addrs...)
+			if len(difference(glue, addrs)) > 0 || len(difference(addrs, glue)) > 0 {
+				differ = true
+			}
+		}
+		if differ {
+			mismatches = append(mismatches, GlueMismatch{Zone: zone, Server: s.Name, Glue: s.Addrs, Authoritative: auth})
+		}
+	}
+	return mismatches
+}
+
+// familyOf returns the addresses of addrs of the family of the A or AAAA
+// qtype.
+func familyOf(addrs []string, qtype uint16) []string {
+	family := 4
+	if qtype == dns.TypeAAAA {
+		family = 6
+	}
+	var fa []string
+	for _, addr := range addrs {
+		if addrFamily(addr) == family {
+			fa = append(fa, addr)
+		}
+	}
+	return fa
+}
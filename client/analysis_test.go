@@ -0,0 +1,62 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckRedundancy(t *testing.T) {
+	ns := func(addrs ...string) Server { return Server{Name: "ns.example.", Addrs: addrs} }
+	tests := []struct {
+		name       string
+		servers    []Server
+		sameIP     bool
+		samePrefix bool
+		score      string
+	}{
+		{"shared v4", []Server{ns("192.0.2.1"), ns("192.0.2.1")}, true, true, RedundancyPoor},
+		{"shared dual stack", []Server{ns("192.0.2.1", "2001:db8::1"), ns("192.0.2.1", "2001:db8::1")}, true, true, RedundancyPoor},
+		{"same v4 prefix", []Server{ns("192.0.2.1"), ns("192.0.2.2")}, false, true, RedundancyPoor},
+		{"split v4/v6", []Server{ns("192.0.2.1"), ns("2001:db8::1")}, false, false, RedundancyFair},
+		{"split v4/v6 with a dual stack server", []Server{ns("192.0.2.1"), ns("2001:db8::1"), ns("192.0.2.1", "2001:db8::1")}, true, true, RedundancyPoor},
+		{"distinct v4", []Server{ns("192.0.2.1"), ns("198.51.100.1")}, false, false, RedundancyFair},
+		{"distinct dual stack", []Server{ns("192.0.2.1", "2001:db8::1"), ns("198.51.100.1", "2001:db8:1::1"), ns("203.0.113.1")}, false, false, RedundancyGood},
+		{"v6 shared, v4 distinct", []Server{ns("192.0.2.1", "2001:db8::1"), ns("198.51.100.1", "2001:db8::1")}, false, false, RedundancyGood},
+		{"unresolved", []Server{ns(), ns()}, false, false, RedundancyFair},
+	}
+	for _, tt := range tests {
+		rd := CheckRedundancy("example.", tt.servers)
+		if rd.SameIP != tt.sameIP || rd.SamePrefix != tt.samePrefix || rd.Score() != tt.score {
+			t.Errorf("%s: SameIP, SamePrefix, Score = %v, %v, %s, want %v, %v, %s",
+				tt.name, rd.SameIP, rd.SamePrefix, rd.Score(), tt.sameIP, tt.samePrefix, tt.score)
+		}
+	}
+}
+
+func TestAliasTargets(t *testing.T) {
+	// The root answers every query: 192.0.2.50 points back to a name
+	// resolving to it, 192.0.2.51 to an unrelated provider name.
+	records := map[string]string{
+		"50.2.0.192.in-addr.arpa. PTR": "50.2.0.192.in-addr.arpa. 300 IN PTR lb.cdn.test.",
+		"51.2.0.192.in-addr.arpa. PTR": "51.2.0.192.in-addr.arpa. 300 IN PTR host-51.isp.test.",
+		"lb.cdn.test. A":               "lb.cdn.test. 300 IN A 192.0.2.50",
+		"host-51.isp.test. A":          "host-51.isp.test. 300 IN A 198.51.100.51",
+	}
+	c, _ := newMockClient(map[string]mockHandler{
+		mockRootAddr: func(m *dns.Msg) *dns.Msg {
+			q := m.Question[0]
+			if s, found := records[q.Name+" "+dns.TypeToString[q.Qtype]]; found {
+				return reply(m, s)
+			}
+			return reply(m)
+		},
+	})
+	answer := []dns.RR{
+		rr("example. 300 IN A 192.0.2.50"),
+		rr("example. 300 IN A 192.0.2.51"),
+	}
+	if targets := c.AliasTargets("example.", answer); !equalStrings(targets, []string{"lb.cdn.test."}) {
+		t.Errorf("AliasTargets = %v, want [lb.cdn.test.]", targets)
+	}
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -10,19 +12,19 @@ import (
 )
 
 var roots = []Server{
-	{"A.root-servers.net.", true, 446311, []string{"198.41.0.4", "2001:503:ba3e::2:30"}, 0, nil},
-	{"B.root-servers.net.", true, 446311, []string{"199.9.14.201", "2001:500:200::b"}, 0, nil},
-	{"C.root-servers.net.", true, 446311, []string{"192.33.4.12", "2001:500:2::c"}, 0, nil},
-	{"D.root-servers.net.", true, 446311, []string{"199.7.91.13", "2001:500:2d::d"}, 0, nil},
-	{"E.root-servers.net.", true, 446311, []string{"192.203.230.10", "2001:500:a8::e"}, 0, nil},
-	{"F.root-servers.net.", true, 446311, []string{"192.5.5.241", "2001:500:2f::f"}, 0, nil},
-	{"G.root-servers.net.", true, 446311, []string{"192.112.36.4", "2001:500:12::d0d"}, 0, nil},
-	{"H.root-servers.net.", true, 446311, []string{"198.97.190.53", "2001:500:1::53"}, 0, nil},
-	{"I.root-servers.net.", true, 446311, []string{"192.36.148.17", "2001:7fe::53"}, 0, nil},
-	{"J.root-servers.net.", true, 446311, []string{"192.58.128.30", "2001:503:c27::2:30"}, 0, nil},
-	{"K.root-servers.net.", true, 446311, []string{"193.0.14.129", "2001:7fd::1"}, 0, nil},
-	{"L.root-servers.net.", true, 446311, []string{"199.7.83.42", "2001:500:9f::42"}, 0, nil},
-	{"M.root-servers.net.", true, 446311, []string{"202.12.27.33", "2001:dc3::35"}, 0, nil},
+	{Name: "A.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"198.41.0.4", "2001:503:ba3e::2:30"}},
+	{Name: "B.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"199.9.14.201", "2001:500:200::b"}},
+	{Name: "C.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"192.33.4.12", "2001:500:2::c"}},
+	{Name: "D.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"199.7.91.13", "2001:500:2d::d"}},
+	{Name: "E.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"192.203.230.10", "2001:500:a8::e"}},
+	{Name: "F.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"192.5.5.241", "2001:500:2f::f"}},
+	{Name: "G.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"192.112.36.4", "2001:500:12::d0d"}},
+	{Name: "H.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"198.97.190.53", "2001:500:1::53"}},
+	{Name: "I.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"192.36.148.17", "2001:7fe::53"}},
+	{Name: "J.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"192.58.128.30", "2001:503:c27::2:30"}},
+	{Name: "K.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"193.0.14.129", "2001:7fd::1"}},
+	{Name: "L.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"199.7.83.42", "2001:500:9f::42"}},
+	{Name: "M.root-servers.net.", HasGlue: true, TTL: 446311, Addrs: []string{"202.12.27.33", "2001:dc3::35"}},
 }
 
 // Server is a name server hostname with associated IP addresses.
@@ -33,16 +35,77 @@ type Server struct {
 	Addrs     []string
 	LookupRTT time.Duration
 	LookupErr error
+	// Hinted is true if Addrs come from the ipv4hint and ipv6hint of a SVCB
+	// record found in the additional section of the delegation.
+	Hinted bool
 }
 
 func (s Server) String() string {
 	return fmt.Sprintf("%s %d NS (%s): %v", s.Name, s.TTL, strings.Join(s.Addrs, ","), s.LookupErr)
 }
 
+// NeedsGlue returns true if the server name is below zone, so the delegation
+// can only be followed using glue records.
+func (s Server) NeedsGlue(zone string) bool {
+	return dns.IsSubDomain(zone, s.Name)
+}
+
+// TTLPolicy defines how cache entries expire.
+type TTLPolicy struct {
+	// Honor makes entries expire after their TTL. Entries with a zero TTL,
+	// like seeded delegations, never expire.
+	Honor bool
+	// Min and Max clamp the TTLs when non zero.
+	Min, Max time.Duration
+}
+
+// expiry returns the expiration time of an entry with ttl added at now, or
+// the zero time if it never expires.
+func (p TTLPolicy) expiry(ttl uint32, now time.Time) time.Time {
+	if !p.Honor || ttl == 0 {
+		return time.Time{}
+	}
+	d := time.Duration(ttl) * time.Second
+	if p.Min > 0 && d < p.Min {
+		d = p.Min
+	}
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	return now.Add(d)
+}
+
+// expired returns true if exp is set and past.
+func expired(exp time.Time) bool {
+	return !exp.IsZero() && time.Now().After(exp)
+}
+
 // DelegationCache store and retrive delegations.
 type DelegationCache struct {
-	c  map[string][]Server
-	mu sync.Mutex
+	// MaxServers limits the total number of servers stored in the cache. Zero
+	// means no limit.
+	MaxServers int
+
+	// Roots are the servers returned for domains without any cached
+	// delegation. Nil means the IANA root servers.
+	Roots []Server
+
+	// TTL sets how delegations expire. The zero value keeps them until Reset.
+	TTL TTLPolicy
+
+	c            map[string][]Server
+	exp          map[string]time.Time // expiration of the zones with a TTL
+	n            int
+	hits, misses int
+	mu           sync.Mutex
+}
+
+// CacheStats holds the number of entries of a cache and the number of hits and
+// misses of its Get method over its lifetime.
+type CacheStats struct {
+	Entries int
+	Hits    int
+	Misses  int
 }
 
 // Get returns the most specific name servers for domain with its matching label.
@@ -53,79 +116,373 @@ func (d *DelegationCache) Get(domain string) (label string, servers []Server) {
 	for offset, end := 0, false; !end; offset, end = dns.NextLabel(domain, offset) {
 		label = domain[offset:]
 		var found bool
-		if _, found = d.c[label]; found {
+		if _, found = d.c[label]; found && expired(d.exp[label]) {
+			d.remove(label)
+			found = false
+		}
+		if found {
+			d.hits++
 			return label, append(servers, d.c[label]...)
 		}
 	}
+	d.misses++
+	if d.Roots != nil {
+		return ".", append(servers, d.Roots...)
+	}
 	return ".", append(servers, roots...)
 }
 
+// Below returns a zone of the cache strictly below name, or "" if none.
+func (d *DelegationCache) Below(name string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = strings.ToLower(name)
+	for zone := range d.c {
+		if zone != name && dns.IsSubDomain(name, zone) && !expired(d.exp[zone]) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// Stats returns the number of zones in the cache and the number of Get calls
+// that found a delegation (hits) or fell back to the roots (misses).
+func (d *DelegationCache) Stats() CacheStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return CacheStats{Entries: len(d.c), Hits: d.hits, Misses: d.misses}
+}
+
 // Add adds a server as a delegation for domain. If addrs is not specified,
-// server will be looked up. Returns false if already there
+// server will be looked up. Returns false if already there or if the cache is
+// full, even after evicting the expired zones. Addresses of a server already
+// there are merged with the new ones.
 func (d *DelegationCache) Add(domain string, server Server) bool {
+	added, _ := d.add(domain, server)
+	return added
+}
+
+// add implements Add and also returns whether server was rejected because the
+// cache is full, after evicting the expired zones.
+func (d *DelegationCache) add(domain string, server Server) (added, full bool) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	domain = strings.ToLower(domain)
-	for _, s2 := range d.c[domain] {
+	for i, s2 := range d.c[domain] {
 		if domainEqual(s2.Name, server.Name) {
-			return false
+			d.c[domain][i] = mergeAddrs(s2, server)
+			return false, false
+		}
+	}
+	if d.full() {
+		for zone, exp := range d.exp {
+			if expired(exp) {
+				d.remove(zone)
+			}
+		}
+		if d.full() {
+			return false, true
 		}
 	}
 	if d.c == nil {
 		d.c = map[string][]Server{}
 	}
 	d.c[domain] = append(d.c[domain], server)
-	return true
+	d.n++
+	if exp := d.TTL.expiry(server.TTL, time.Now()); !exp.IsZero() {
+		// The zone expires with its first server to expire.
+		if cur, found := d.exp[domain]; !found || exp.Before(cur) {
+			if d.exp == nil {
+				d.exp = map[string]time.Time{}
+			}
+			d.exp[domain] = exp
+		}
+	}
+	return true, false
+}
+
+// remove removes the delegation of zone.
+func (d *DelegationCache) remove(zone string) {
+	d.n -= len(d.c[zone])
+	delete(d.c, zone)
+	delete(d.exp, zone)
+}
+
+// mergeAddrs returns s with the addresses of s2 it does not have yet.
+func mergeAddrs(s, s2 Server) Server {
+	addrs := s.Addrs
+	for _, addr := range s2.Addrs {
+		found := false
+		for _, a := range addrs {
+			if net.ParseIP(a).Equal(net.ParseIP(addr)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// Copy on write: s.Addrs may be shared with servers returned by Get.
+			addrs = append(addrs[:len(addrs):len(addrs)], addr)
+		}
+	}
+	s.Addrs = addrs
+	s.HasGlue = s.HasGlue || s2.HasGlue
+	return s
+}
+
+// Full returns true if the cache reached MaxServers.
+func (d *DelegationCache) Full() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.full()
+}
+
+func (d *DelegationCache) full() bool {
+	return d.MaxServers > 0 && d.n >= d.MaxServers
+}
+
+// Reset removes all delegations and clears the statistics. MaxServers, Roots
+// and TTL are kept.
+func (d *DelegationCache) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.c, d.exp, d.n, d.hits, d.misses = nil, nil, 0, 0, 0
 }
 
 // AddressAttempt stores resolved address and retry count if it's unresolved
 type AddressAttempt struct {
 	Addresss   []string
 	RetryCount uint8
+	// Resolved is true if the lookup succeeded, even without any address.
+	Resolved bool
+	// Expires is when the addresses expire with a TTL honoring policy, zero
+	// for never.
+	Expires time.Time
+}
+
+type lookupKey struct {
+	label string
+	qtype uint16
 }
 
-// LookupCache stores mixed lookup results for A and AAAA records of labels with
-// not support of TTL.
+// LookupCache stores lookup results of labels for A and AAAA records, tracked
+// separately so a name without any address in one family is not retried for
+// the other.
 type LookupCache struct {
-	c  map[string]AddressAttempt
-	mu sync.Mutex
+	// TTL sets how addresses expire. The zero value keeps them until Reset.
+	TTL TTLPolicy
+
+	c            map[lookupKey]AddressAttempt
+	hits, misses int
+	mu           sync.Mutex
+}
+
+func newLookupKey(label string, qtype uint16) lookupKey {
+	return lookupKey{label: strings.ToLower(label), qtype: qtype}
 }
 
-// IncAttempt increase attempt to recursive resolve the address
-func (c *LookupCache) IncAttempt(label string) {
+// IncAttempt increase attempt to recursive resolve the qtype address of label.
+func (c *LookupCache) IncAttempt(label string, qtype uint16) {
+	c.incAttempt(label, qtype, false)
+}
+
+// incAttempt increases the attempt count of label if unresolved, or
+// unconditionally if always is true.
+func (c *LookupCache) incAttempt(label string, qtype uint16, always bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.c == nil {
-		c.c = map[string]AddressAttempt{}
+		c.c = map[lookupKey]AddressAttempt{}
 	}
-	key := strings.ToLower(label)
+	key := newLookupKey(label, qtype)
 	aa := c.c[key]
-	if len(aa.Addresss) == 0 {
+	if !aa.Resolved || always {
 		aa.RetryCount++
 		c.c[key] = aa
 	}
 }
-func (c *LookupCache) Set(label string, addrs []string) {
+
+// Set stores the result of a successful qtype lookup of label, expiring after
+// ttl with a TTL honoring policy. An empty addrs means the name has no address
+// of this type.
+func (c *LookupCache) Set(label string, qtype uint16, addrs []string, ttl uint32) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.c == nil {
-		c.c = map[string]AddressAttempt{}
-	}
-	key := strings.ToLower(label)
-	if len(addrs) == 0 {
-		aa := c.c[key]
-		if len(aa.Addresss) == 0 {
-			aa.RetryCount++
-			c.c[key] = aa
+		c.c = map[lookupKey]AddressAttempt{}
+	}
+	key := newLookupKey(label, qtype)
+	c.c[key] = AddressAttempt{Addresss: addrs, RetryCount: c.c[key].RetryCount, Resolved: true, Expires: c.TTL.expiry(ttl, time.Now())}
+}
+
+// SetGlue stores the glue addrs of label with ttl for the families they belong
+// to.
+func (c *LookupCache) SetGlue(label string, addrs []string, ttl uint32) {
+	var a, aaaa []string
+	for _, addr := range addrs {
+		if addrFamily(addr) == 6 {
+			aaaa = append(aaaa, addr)
+		} else {
+			a = append(a, addr)
 		}
+	}
+	if len(a) > 0 {
+		c.Set(label, dns.TypeA, a, ttl)
+	}
+	if len(aaaa) > 0 {
+		c.Set(label, dns.TypeAAAA, aaaa, ttl)
+	}
+}
+
+// Get retrieve the saved qtype address of label or the attempt
+func (c *LookupCache) Get(label string, qtype uint16) AddressAttempt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := newLookupKey(label, qtype)
+	aa := c.c[key]
+	if aa.Resolved && expired(aa.Expires) {
+		delete(c.c, key)
+		aa = AddressAttempt{}
+	}
+	if aa.Resolved {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return aa
+}
+
+// Stats returns the number of name and type entries in the cache and the
+// number of Get calls that found a resolved entry (hits) or not (misses).
+func (c *LookupCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: len(c.c), Hits: c.hits, Misses: c.misses}
+}
+
+// Reset removes all addresses and attempts and clears the statistics. TTL is
+// kept.
+func (c *LookupCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c, c.hits, c.misses = nil, 0, 0
+}
+
+type answerKey struct {
+	zone, qname string
+	qtype       uint16
+}
+
+type answerEntry struct {
+	rs  Responses
+	exp time.Time
+}
+
+// AnswerCache stores the responses of the steps of recursive queries by zone,
+// name and type until the smallest TTL of their records expires.
+type AnswerCache struct {
+	// TTL clamps the TTLs of the responses with its Min and Max. Responses
+	// always expire, whatever Honor.
+	TTL TTLPolicy
+
+	c            map[answerKey]answerEntry
+	hits, misses int
+	mu           sync.Mutex
+}
+
+func newAnswerKey(zone, qname string, qtype uint16) answerKey {
+	return answerKey{zone: strings.ToLower(zone), qname: strings.ToLower(qname), qtype: qtype}
+}
+
+// Set stores the responses rs of the servers of zone to the qtype query of
+// qname. Nothing is stored if none of them succeeded or their smallest TTL is
+// zero.
+func (c *AnswerCache) Set(zone, qname string, qtype uint16, rs Responses) {
+	ttl, ok := responsesTTL(rs)
+	if !ok || ttl == 0 {
 		return
 	}
-	c.c[key] = AddressAttempt{Addresss: addrs, RetryCount: 1}
+	p := c.TTL
+	p.Honor = true
+	exp := p.expiry(ttl, time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		c.c = map[answerKey]answerEntry{}
+	}
+	c.c[newAnswerKey(zone, qname, qtype)] = answerEntry{rs: append(Responses(nil), rs...), exp: exp}
+}
+
+// Get returns a copy of the responses stored for the qtype query of qname to
+// the servers of zone, marked as Cached with a zero RTT.
+func (c *AnswerCache) Get(zone, qname string, qtype uint16) (Responses, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := newAnswerKey(zone, qname, qtype)
+	e, found := c.c[key]
+	if found && expired(e.exp) {
+		delete(c.c, key)
+		found = false
+	}
+	if !found {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	rs := make(Responses, 0, len(e.rs))
+	for _, r := range e.rs {
+		r.Cached, r.RTT, r.Server.LookupRTT = true, 0, 0
+		r.Start = time.Now()
+		rs = append(rs, r)
+	}
+	return rs, true
+}
+
+// Stats returns the number of entries in the cache and the number of Get
+// calls that found an entry (hits) or not (misses).
+func (c *AnswerCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: len(c.c), Hits: c.hits, Misses: c.misses}
 }
 
-// Get retrieve the saved address or the attempt
-func (c *LookupCache) Get(label string) AddressAttempt {
+// Reset removes all responses and clears the statistics. TTL is kept.
+func (c *AnswerCache) Reset() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.c[strings.ToLower(label)]
+	c.c, c.hits, c.misses = nil, 0, 0
+}
+
+// responsesTTL returns the smallest TTL of the records of the successful
+// responses of rs, using the negative caching TTL of SOA records (RFC 2308
+// section 5). It is zero for responses without records and ok is false if no
+// response succeeded.
+func responsesTTL(rs Responses) (ttl uint32, ok bool) { // nolint: nonamedreturns
+	for _, r := range rs {
+		if r.Err != nil || r.Msg == nil {
+			continue
+		}
+		if !ok {
+			ttl, ok = math.MaxUint32, true
+		}
+		for _, sec := range [][]dns.RR{r.Msg.Answer, r.Msg.Ns, r.Msg.Extra} {
+			for _, rr := range sec {
+				t := rr.Header().Ttl
+				switch rr := rr.(type) {
+				case *dns.OPT:
+					continue
+				case *dns.SOA:
+					if rr.Minttl < t {
+						t = rr.Minttl
+					}
+				}
+				if t < ttl {
+					ttl = t
+				}
+			}
+		}
+	}
+	if ttl == math.MaxUint32 {
+		ttl = 0
+	}
+	return ttl, ok
 }
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDelegationCacheMaxServers(t *testing.T) {
+	d := &DelegationCache{MaxServers: 2}
+	for i, name := range []string{"ns1.example.", "ns2.example.", "ns3.example."} {
+		s := Server{Name: name, HasGlue: true, Addrs: []string{"192.0.2." + strconv.Itoa(i+1)}}
+		if added, want := d.Add("example.", s), i < 2; added != want {
+			t.Errorf("Add(%s) = %v, want %v", name, added, want)
+		}
+	}
+	if !d.Full() {
+		t.Error("cache not full")
+	}
+	if _, servers := d.Get("www.example."); len(servers) != 2 {
+		t.Errorf("servers = %v, want 2", servers)
+	}
+}
+
+func TestRecursiveQueryDelegationCacheFull(t *testing.T) {
+	const subAddr = "192.0.2.20"
+	handlers := map[string]mockHandler{
+		mockRootAddr: func(m *dns.Msg) *dns.Msg {
+			return referral(m, "example.", "ns1.example.", mockExampleAddr)
+		},
+		mockExampleAddr: func(m *dns.Msg) *dns.Msg {
+			return referral(m, "sub.example.", "ns1.sub.example.", subAddr)
+		},
+		subAddr: func(m *dns.Msg) *dns.Msg {
+			return reply(m, "www.sub.example. 300 IN A 198.51.100.2")
+		},
+	}
+	c, e := newMockClient(handlers)
+	c.DCache.MaxServers = 1
+	var warnings []string
+	tracer := Tracer{
+		GotIntermediaryResponse: func(int, *dns.Msg, Responses, ResponseType) {},
+		Warning:                 func(msg string) { warnings = append(warnings, msg) },
+	}
+	r, _, err := c.RecursiveQuery(query("www.sub.example.", dns.TypeA), tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("answer = %v, want www.sub.example. A", r.Answer)
+	}
+	if n := len(e.Queries()); n != 3 {
+		t.Errorf("%d queries, want 3", n)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "sub.example.: delegation cache full") {
+		t.Errorf("warnings = %q, want a single cache full warning for sub.example.", warnings)
+	}
+}
+
+func TestRecursiveQueryTooManySteps(t *testing.T) {
+	handlers := map[string]mockHandler{
+		mockRootAddr: func(m *dns.Msg) *dns.Msg {
+			if m.Question[0].Name == "a.example." {
+				return reply(m, "a.example. 300 IN CNAME b.example.")
+			}
+			return reply(m, "b.example. 300 IN CNAME a.example.")
+		},
+	}
+	c, _ := newMockClient(handlers)
+	r, _, err := c.RecursiveQuery(query("a.example.", dns.TypeA), Tracer{})
+	if r != nil || !errors.Is(err, ErrTooManySteps) {
+		t.Errorf("got %v, %v, want ErrTooManySteps", r, err)
+	}
+}
+
+func TestDelegationCacheAddMerge(t *testing.T) {
+	d := DelegationCache{MaxServers: 1}
+	if added, full := d.add("example.", Server{Name: "ns1.example.", HasGlue: true, Addrs: []string{"192.0.2.1"}}); !added || full {
+		t.Fatalf("first add = %v, %v, want added", added, full)
+	}
+	if added, full := d.add("example.", Server{Name: "NS1.example.", HasGlue: true, Addrs: []string{"192.0.2.1", "2001:db8::1"}}); added || full {
+		t.Errorf("second add = %v, %v, want merged without full", added, full)
+	}
+}
+
+func TestDelegationCacheAddTwice(t *testing.T) {
+	d := DelegationCache{}
+	d.Add("example.", Server{Name: "ns1.example.", HasGlue: true, Addrs: []string{"192.0.2.1"}})
+	_, before := d.Get("www.example.")
+	if d.Add("example.", Server{Name: "ns1.example.", HasGlue: true, Addrs: []string{"192.0.2.1", "2001:db8::1"}}) {
+		t.Error("second Add returned true, want false for a known server")
+	}
+	label, servers := d.Get("www.example.")
+	if label != "example." || len(servers) != 1 {
+		t.Fatalf("Get = %s %v, want the single ns1.example.", label, servers)
+	}
+	if want := []string{"192.0.2.1", "2001:db8::1"}; !equalStrings(servers[0].Addrs, want) {
+		t.Errorf("addrs = %v, want %v", servers[0].Addrs, want)
+	}
+	if len(before[0].Addrs) != 1 {
+		t.Errorf("servers returned before the merge changed: %v", before[0].Addrs)
+	}
+	if st := d.Stats(); st.Entries != 1 {
+		t.Errorf("%d entries, want 1", st.Entries)
+	}
+
+	// Glue learned later completes a server added without any.
+	d.Add("example.", Server{Name: "ns2.example."})
+	d.Add("example.", Server{Name: "ns2.example.", HasGlue: true, Addrs: []string{"192.0.2.2"}})
+	_, servers = d.Get("example.")
+	if len(servers) != 2 || !servers[1].HasGlue || len(servers[1].Addrs) != 1 {
+		t.Errorf("ns2.example. = %+v, want its glue merged", servers[1])
+	}
+}
+
+func TestLookupCacheSingleFamily(t *testing.T) {
+	var c LookupCache
+	c.Set("v4.example.", dns.TypeA, []string{"192.0.2.1"}, 300)
+	c.Set("v4.example.", dns.TypeAAAA, nil, 300)
+	c.Set("V6.example.", dns.TypeAAAA, []string{"2001:db8::1"}, 300)
+	c.Set("v6.example.", dns.TypeA, nil, 300)
+	tests := []struct {
+		label string
+		qtype uint16
+		addrs int
+	}{
+		{"v4.example.", dns.TypeA, 1},
+		{"v4.example.", dns.TypeAAAA, 0},
+		{"v6.example.", dns.TypeA, 0},
+		{"v6.example.", dns.TypeAAAA, 1},
+	}
+	for _, tt := range tests {
+		aa := c.Get(tt.label, tt.qtype)
+		if !aa.Resolved || len(aa.Addresss) != tt.addrs {
+			t.Errorf("%s %s = %+v, want resolved with %d address(es)", tt.label, dns.TypeToString[tt.qtype], aa, tt.addrs)
+		}
+		// Resolved names without addresses of a family are not retried.
+		c.IncAttempt(tt.label, tt.qtype)
+		if aa := c.Get(tt.label, tt.qtype); aa.RetryCount != 0 {
+			t.Errorf("%s %s retry count = %d, want 0", tt.label, dns.TypeToString[tt.qtype], aa.RetryCount)
+		}
+	}
+	c.IncAttempt("unknown.example.", dns.TypeA)
+	if aa := c.Get("unknown.example.", dns.TypeA); aa.Resolved || aa.RetryCount != 1 {
+		t.Errorf("unknown.example. = %+v, want 1 unresolved attempt", aa)
+	}
+}
+
+func TestLookupHostSingleFamily(t *testing.T) {
+	handlers := exampleHandlers()
+	handlers[mockExampleAddr] = func(m *dns.Msg) *dns.Msg {
+		q := m.Question[0]
+		switch {
+		case q.Name == "v4.example." && q.Qtype == dns.TypeA:
+			return reply(m, "v4.example. 300 IN A 192.0.2.1")
+		case q.Name == "v6.example." && q.Qtype == dns.TypeAAAA:
+			return reply(m, "v6.example. 300 IN AAAA 2001:db8::1")
+		}
+		return reply(m) // NODATA
+	}
+	c, e := newMockClient(handlers)
+	for name, want := range map[string]string{"v4.example.": "192.0.2.1", "v6.example.": "2001:db8::1"} {
+		addrs, _ := c.LookupHost(name)
+		if len(addrs) != 1 || addrs[0] != want {
+			t.Errorf("LookupHost(%s) = %v, want [%s]", name, addrs, want)
+		}
+	}
+	n := len(e.Queries())
+	for name := range map[string]bool{"v4.example.": true, "v6.example.": true} {
+		if addrs, _ := c.LookupHost(name); len(addrs) != 1 {
+			t.Errorf("cached LookupHost(%s) = %v, want 1 address", name, addrs)
+		}
+	}
+	if qs := e.Queries(); len(qs) != n {
+		t.Errorf("cached lookups sent %v", qs[n:])
+	}
+}
+
+func TestSetRoots(t *testing.T) {
+	c, e := newMockClient(exampleHandlers())
+	roots := []Server{{Name: "a.root.test.", HasGlue: true, Addrs: []string{mockRootAddr}}}
+	c.SetRoots(roots)
+	roots[0].Name = "changed.test."
+	c.DCache.Add("example.", Server{Name: "ns1.example.", HasGlue: true, Addrs: []string{mockExampleAddr}})
+	c.Reset()
+	label, servers := c.DCache.Get("www.example.")
+	if label != "." || len(servers) != 1 || servers[0].Name != "a.root.test." {
+		t.Fatalf("Get(www.example.) = %s %v, want the injected root", label, servers)
+	}
+	if _, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), Tracer{}); err != nil {
+		t.Fatal(err)
+	}
+	if qs := e.Queries(); len(qs) == 0 || qs[0].Addr != mockRootAddr {
+		t.Errorf("queries = %v, want the injected root first", qs)
+	}
+}
+
+func TestRecursiveQueryNoCacheRoots(t *testing.T) {
+	c, e := newMockClient(exampleHandlers())
+	c.NoCache = true
+	roots := []Server{{Name: "a.root.test.", HasGlue: true, Addrs: []string{mockRootAddr}}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			c.SetRoots(roots)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), Tracer{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	// Each query walks the delegations from the injected root.
+	qs := e.Queries()
+	if len(qs) != 4 || qs[0].Addr != mockRootAddr || qs[2].Addr != mockRootAddr {
+		t.Errorf("queries = %v, want the root then ns1.example. twice", qs)
+	}
+}
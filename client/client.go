@@ -1,8 +1,15 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -10,15 +17,183 @@ import (
 	"github.com/miekg/dns"
 )
 
+const (
+	// DefaultMaxDelegationServers is the default number of NS records processed
+	// from a single delegation.
+	DefaultMaxDelegationServers = 20
+
+	// DefaultMaxCachedServers is the default number of servers tracked by the
+	// delegation cache.
+	DefaultMaxCachedServers = 1000
+
+	// maxSteps bounds the number of steps of a recursive query.
+	maxSteps = 100
+)
+
+// DefaultRetryRcodes are the default RetryRcodes.
+var DefaultRetryRcodes = []int{dns.RcodeServerFailure, dns.RcodeRefused}
+
+// ErrIDMismatch is set on responses whose ID does not match the query ID.
+var ErrIDMismatch = errors.New("response ID mismatch (possible spoofing attempt)")
+
+// ErrQuestionMismatch is set on responses whose question section differs from
+// the query.
+var ErrQuestionMismatch = errors.New("response question mismatch")
+
+// ErrCaseMismatch is set on responses whose question does not echo the exact
+// letter case of the query randomized with Use0x20.
+var ErrCaseMismatch = errors.New("response question case mismatch (possible spoofing attempt)")
+
+// ErrNotQuery is returned when a recursive query has an opcode other than
+// QUERY: other opcodes, like NOTIFY, are meant for a single server.
+var ErrNotQuery = errors.New("only QUERY messages can be resolved recursively")
+
+// ErrTooManySteps is returned when a recursive query does not end within the
+// maximum number of steps, e.g. because of a delegation loop.
+var ErrTooManySteps = errors.New("too many steps")
+
+// ErrQuestionCount is returned when a recursive query is not made of exactly
+// one question.
+var ErrQuestionCount = errors.New("query must have exactly one question")
+
+// ErrMalformed is set on responses that could not be unpacked.
+var ErrMalformed = errors.New("malformed response")
+
+// ErrStrictReferral is returned in StrictAbort mode when a referral violates
+// the protocol.
+var ErrStrictReferral = errors.New("invalid referral")
+
+// ErrNotDelegated is returned by QueryZone for a name that is not a delegated
+// zone.
+var ErrNotDelegated = errors.New("not a delegated zone")
+
+// ErrBrokenDelegation is set on responses of delegated servers denying the
+// existence of the zone they were delegated.
+var ErrBrokenDelegation = errors.New("broken delegation")
+
+// ErrNoResponse is set on exchanges returning neither a response nor an
+// error, which a custom Exchanger may do.
+var ErrNoResponse = errors.New("no response")
+
+// ErrResponseTooLarge is set on responses exceeding MaxResponseSize when
+// DropOversized is enabled.
+var ErrResponseTooLarge = errors.New("response too large")
+
 // Client is a DNS client capable of performing parallel requests.
 type Client struct {
 	dns.Client
 	DCache DelegationCache
 	LCache LookupCache
+	// ACache, if set, stores the responses of each step so later queries
+	// reuse them until they expire instead of querying the servers again.
+	ACache *AnswerCache
+
+	// MaxDelegationServers limits the number of NS records processed from a
+	// single delegation. Extra records are ignored. Zero means no limit.
+	MaxDelegationServers int
+
+	// NoCache makes DCache and LCache write-only: each query walks the
+	// delegations from the root and every NS name is resolved again. Retry
+	// counting still applies, and every lookup counts as an attempt, so a given
+	// NS name is resolved at most maxRetryCount times before its last known
+	// addresses are used. This bounds lookups for circular delegations.
+	// Delegations added to DCache beforehand are not read back either.
+	NoCache bool
+
+	// FastLookup makes NS name resolution return as soon as either the A or
+	// the AAAA lookup returns addresses instead of waiting for both. The other
+	// family is still added to LCache when it arrives.
+	FastLookup bool
+
+	// MaxServersPerStep limits the number of servers queried at each step,
+	// preferring the ones with known addresses. Zero means no limit.
+	MaxServersPerStep int
+
+	// FirstAnswer makes each step use the first successful response instead
+	// of waiting for all the servers to answer. Pending exchanges are
+	// canceled and only the responses received so far are reported.
+	FirstAnswer bool
+
+	// RetryRcodes lists the rcodes making a response unusable when another
+	// server of the step answered with a different one, as if the query was
+	// retried on that server. NOERROR and NXDOMAIN are authoritative answers
+	// and are never retried, even if listed.
+	RetryRcodes []int
+
+	// RetryBackoff is the delay before retrying the lookup of an NS name that
+	// previously failed. It doubles with each attempt and is randomized by up
+	// to half its value. Zero disables the delay.
+	RetryBackoff time.Duration
+
+	// MaxResponseSize is the length in bytes above which a response is
+	// reported as oversized. Zero means no limit.
+	MaxResponseSize int
+
+	// DropOversized makes responses larger than MaxResponseSize fail with
+	// ErrResponseTooLarge instead of only being reported.
+	DropOversized bool
+
+	// Logger receives debug diagnostics about the decisions taken while
+	// resolving (delegations, CNAMEs, lookups and retries). Nil disables
+	// logging.
+	Logger *slog.Logger
+
+	// Strict reports referrals violating the protocol (see
+	// ReferralViolations) as warnings. StrictAbort also ends the query with
+	// ErrStrictReferral.
+	Strict      bool
+	StrictAbort bool
+
+	// Use0x20 randomizes the case of the letters of the name of each query
+	// (dns-0x20) and rejects the responses not echoing it exactly with
+	// ErrCaseMismatch, making spoofed responses harder to forge.
+	Use0x20 bool
+
+	// Family restricts queries to the IPv4 (4) or IPv6 (6) addresses of the
+	// servers. Servers with glue of the other family only are looked up. Zero
+	// uses both families.
+	Family int
+
+	// Transports lists the networks ("udp", "tcp" or "tcp-tls") tried in
+	// order for each exchange, falling back to the next one when the response
+	// is truncated or the exchange times out. Empty means Net only.
+	Transports []string
+
+	// ReadBuffer and WriteBuffer set the size in bytes of the operating system
+	// receive and send buffers of each connection. Zero keeps the system
+	// default (around 200KiB on Linux). The kernel caps the values, to
+	// net.core.rmem_max and net.core.wmem_max on Linux, so raising them for
+	// large batches may also require raising these limits.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// DialContext, if set, is used to open the connection of each exchange
+	// instead of the embedded dns.Client dialer, e.g. to go through a proxy.
+	// network is "udp" or "tcp"; TLS is negotiated over the returned
+	// connection when the transport is "tcp-tls".
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Exchanger, if set, performs all the exchanges of the client, including
+	// NS name lookups, instead of the embedded dns.Client. It takes precedence
+	// over DialContext and is typically used to answer from canned responses.
+	Exchanger Exchanger
+
+	// Overrides maps lower case fully qualified zone names to the servers to
+	// query instead of the delegated ones when the trace reaches the zone.
+	// Servers without Addrs are resolved.
+	Overrides map[string][]Server
 
 	maxRetryCount uint8
 }
 
+// Exchanger sends m to the server at addr (host:port) and returns its response
+// with the round trip time. *dns.Client implements it.
+type Exchanger interface {
+	ExchangeContext(ctx context.Context, m *dns.Msg, addr string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+var _ Exchanger = (*dns.Client)(nil)
+
 type ResponseType int
 
 const (
@@ -28,13 +203,46 @@ const (
 	ResponseTypeFinal
 )
 
+func (t ResponseType) String() string {
+	switch t {
+	case ResponseTypeDelegation:
+		return "delegation"
+	case ResponseTypeCNAME:
+		return "cname"
+	case ResponseTypeFinal:
+		return "final"
+	default:
+		return "unknown"
+	}
+}
+
 // Response stores a DNS response.
 type Response struct {
 	Server Server
 	Addr   string
+	Family int // IP family of Addr: 4 or 6
+	Zone   string
 	Msg    *dns.Msg
+	Start  time.Time
 	RTT    time.Duration
 	Err    error
+
+	// Keepalive is the idle timeout advertised by the server with the EDNS0
+	// TCP keepalive option (RFC 7828) on stream transports, or zero.
+	Keepalive time.Duration
+
+	// Transport is the network the response was received over: "udp", "tcp"
+	// or "tcp-tls". Fallbacks is the number of transports tried before it.
+	Transport string
+	Fallbacks int
+
+	// LocalPort is the source port the query was sent from, or 0 if unknown
+	// (e.g. with a custom Exchanger).
+	LocalPort int
+
+	// Cached is true if the response comes from ACache rather than the
+	// network.
+	Cached bool
 }
 
 type Responses []Response
@@ -53,115 +261,755 @@ func (rs Responses) Fastest() *Response {
 	return &fr
 }
 
+// Ranked returns the successful responses of rs from the fastest to the
+// slowest, using the same criteria as Fastest: the query RTT plus the time
+// spent resolving the server name.
+func (rs Responses) Ranked() Responses {
+	var ranked Responses
+	for _, r := range rs {
+		if r.Err == nil {
+			ranked = append(ranked, r)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].RTT+ranked[i].Server.LookupRTT < ranked[j].RTT+ranked[j].Server.LookupRTT
+	})
+	return ranked
+}
+
+// ByServer returns a copy of rs sorted by server name then address, an order
+// independent of the completion of the queries.
+func (rs Responses) ByServer() Responses {
+	sorted := append(Responses(nil), rs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Server.Name != sorted[j].Server.Name {
+			return sorted[i].Server.Name < sorted[j].Server.Name
+		}
+		return sorted[i].Addr < sorted[j].Addr
+	})
+	return sorted
+}
+
+// Percentile returns the p-th percentile (0 < p <= 100) of the RTT of the
+// successful responses in rs using the nearest-rank method, or 0 if none
+// succeeded.
+func (rs Responses) Percentile(p float64) time.Duration {
+	rtts := make([]time.Duration, 0, len(rs))
+	for _, r := range rs {
+		if r.Err == nil {
+			rtts = append(rtts, r.RTT)
+		}
+	}
+	if len(rtts) == 0 {
+		return 0
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(rtts))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(rtts) {
+		rank = len(rtts)
+	}
+	return rtts[rank-1]
+}
+
+// Elapsed returns the wall time between the first query sent and the last
+// response or failure received in rs.
+func (rs Responses) Elapsed() time.Duration {
+	var first, last time.Time
+	for _, r := range rs {
+		if first.IsZero() || r.Start.Before(first) {
+			first = r.Start
+		}
+		if end := r.Start.Add(r.RTT); end.After(last) {
+			last = end
+		}
+	}
+	return last.Sub(first)
+}
+
 type Tracer struct {
 	GotIntermediaryResponse func(i int, m *dns.Msg, rs Responses, rtype ResponseType)
 	FollowingCNAME          func(domain, target string)
+	Warning                 func(msg string)
+
+	// OnWire, if set, receives the packed query and response of each exchange
+	// with the zone servers, the response being nil on failure. server is the
+	// address queried. Calls of a step are serialized but may come in any
+	// order. The response is packed again from the parsed message.
+	OnWire func(server string, query, response []byte)
+}
+
+// MultiTracer returns a Tracer calling the hooks of all tracers in order.
+func MultiTracer(tracers ...Tracer) Tracer {
+	var t Tracer
+	for _, tr := range tracers {
+		tr, prev := tr, t
+		if tr.GotIntermediaryResponse != nil {
+			t.GotIntermediaryResponse = func(i int, m *dns.Msg, rs Responses, rtype ResponseType) {
+				if prev.GotIntermediaryResponse != nil {
+					prev.GotIntermediaryResponse(i, m, rs, rtype)
+				}
+				tr.GotIntermediaryResponse(i, m, rs, rtype)
+			}
+		}
+		if tr.FollowingCNAME != nil {
+			t.FollowingCNAME = func(domain, target string) {
+				if prev.FollowingCNAME != nil {
+					prev.FollowingCNAME(domain, target)
+				}
+				tr.FollowingCNAME(domain, target)
+			}
+		}
+		if tr.Warning != nil {
+			t.Warning = func(msg string) {
+				if prev.Warning != nil {
+					prev.Warning(msg)
+				}
+				tr.Warning(msg)
+			}
+		}
+		if tr.OnWire != nil {
+			t.OnWire = func(server string, query, response []byte) {
+				if prev.OnWire != nil {
+					prev.OnWire(server, query, response)
+				}
+				tr.OnWire(server, query, response)
+			}
+		}
+	}
+	return t
+}
+
+func (t Tracer) warn(format string, a ...interface{}) {
+	if t.Warning != nil {
+		t.Warning(fmt.Sprintf(format, a...))
+	}
 }
 
 // New creates a new Client.
 func New(maxRetryCount uint8) Client {
 	return Client{
-		DCache: DelegationCache{},
+		DCache: DelegationCache{MaxServers: DefaultMaxCachedServers},
 		LCache: LookupCache{},
 
+		MaxDelegationServers: DefaultMaxDelegationServers,
+		RetryRcodes:          append([]int(nil), DefaultRetryRcodes...),
+
 		maxRetryCount: maxRetryCount,
 	}
 }
 
+// SetRoots makes queries start from servers instead of the IANA root servers
+// when no delegation is cached. Servers without Addrs are resolved from the
+// other roots, so at least one of them should have addresses.
+func (c *Client) SetRoots(servers []Server) {
+	c.DCache.mu.Lock()
+	defer c.DCache.mu.Unlock()
+	c.DCache.Roots = append([]Server(nil), servers...)
+}
+
+// Reset clears the delegation and lookup caches so c can be reused for
+// unrelated traces. Settings, including the roots, are kept. It is safe to
+// call concurrently with queries, which then see a cold cache.
+func (c *Client) Reset() {
+	c.DCache.Reset()
+	c.LCache.Reset()
+	if c.ACache != nil {
+		c.ACache.Reset()
+	}
+}
+
 // ParallelQuery perform an exchange using m with all servers in parallel and
 // return all responses.
 func (c *Client) ParallelQuery(m *dns.Msg, servers []Server) Responses {
-	rc := make(chan Response)
+	return c.ParallelQueryContext(context.Background(), m, servers)
+}
+
+// ParallelQueryContext is like ParallelQuery but aborts pending exchanges
+// when ctx is done.
+func (c *Client) ParallelQueryContext(ctx context.Context, m *dns.Msg, servers []Server) Responses {
+	return c.parallelQuery(ctx, m, servers, nil)
+}
+
+// parallelQuery implements ParallelQueryContext, also passing the packed query
+// and response of each exchange to onWire if not nil.
+func (c *Client) parallelQuery(ctx context.Context, m *dns.Msg, servers []Server, onWire func(server string, query, response []byte)) Responses {
+	var wireMu sync.Mutex
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	n := 0
+	for _, s := range servers {
+		n += len(s.Addrs)
+	}
+	rc := make(chan Response, n) // pending exchanges may finish after return
 	cnt := 0
 	for _, s := range servers {
-		for _, addr := range s.Addrs {
+		for _, addr := range c.familyAddrs(s.Addrs) {
 			cnt++
 			go func(s Server, addr string) {
 				r := Response{
 					Server: s,
 					Addr:   addr,
+					Family: addrFamily(addr),
+					Start:  time.Now(),
+				}
+				var q *dns.Msg
+				transports := c.transports()
+				for i, network := range transports {
+					q = m.Copy()
+					if c.Use0x20 {
+						q.Question[0].Name = mixCase(q.Question[0].Name)
+					}
+					if stream(network) {
+						requestKeepalive(q)
+					}
+					r.Transport, r.Fallbacks = network, i
+					r.Msg, r.RTT, r.LocalPort, r.Err = c.exchange(ctx, q, s, addr, network)
+					if onWire != nil {
+						query, _ := q.Pack()
+						var resp []byte
+						if r.Msg != nil {
+							resp, _ = r.Msg.Pack()
+						}
+						wireMu.Lock()
+						onWire(addr, query, resp)
+						wireMu.Unlock()
+					}
+					if i == len(transports)-1 || ctx.Err() != nil || !fallback(r) {
+						break
+					}
+					c.debug("falling back", "server", s.Name, "addr", addr, "from", network, "to", transports[i+1])
+				}
+				if r.Fallbacks > 0 {
+					r.RTT = time.Since(r.Start) // include the failed transports
+				}
+				var derr *dns.Error
+				if errors.Is(r.Err, dns.ErrId) || (r.Err == nil && r.Msg.Id != q.Id) {
+					r.Err = ErrIDMismatch
+				} else if errors.As(r.Err, &derr) {
+					r.Err = fmt.Errorf("%w: %v", ErrMalformed, r.Err)
+				} else if r.Err == nil && !questionMatch(q, r.Msg) {
+					r.Err = ErrQuestionMismatch
+				} else if r.Err == nil && c.Use0x20 && len(r.Msg.Question) > 0 && r.Msg.Question[0].Name != q.Question[0].Name {
+					r.Err = ErrCaseMismatch
+				}
+				if r.Err == nil && c.DropOversized && c.oversized(r.Msg) {
+					r.Err = fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, r.Msg.Len())
+				}
+				if r.Err == nil && stream(r.Transport) {
+					r.Keepalive = keepalive(r.Msg)
+				}
+				if r.Err != nil && r.RTT == 0 {
+					r.RTT = time.Since(r.Start) // report time spent until failure
 				}
-				r.Msg, r.RTT, r.Err = c.Exchange(m.Copy(), net.JoinHostPort(addr, "53"))
 				rc <- r
 			}(s, addr)
 		}
 	}
 	rs := make([]Response, 0, cnt)
 	for ; cnt > 0; cnt-- {
-		rs = append(rs, <-rc)
+		r := <-rc
+		rs = append(rs, r)
+		if c.FirstAnswer && r.Err == nil && !c.retryRcode(r.Msg.Rcode) {
+			break
+		}
 	}
 	return rs
 }
 
+// retryRcode returns true if a response with rcode should be replaced by the
+// response of another server, per RetryRcodes.
+func (c *Client) retryRcode(rcode int) bool {
+	if rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError {
+		return false
+	}
+	for _, rc := range c.RetryRcodes {
+		if rc == rcode {
+			return true
+		}
+	}
+	return false
+}
+
+func addrFamily(addr string) int {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return 6
+	}
+	return 4
+}
+
+// familyAddrs returns the addresses of addrs usable with the Family of c.
+func (c *Client) familyAddrs(addrs []string) []string {
+	if c.Family == 0 {
+		return addrs
+	}
+	var usable []string
+	for _, addr := range addrs {
+		if addrFamily(addr) == c.Family {
+			usable = append(usable, addr)
+		}
+	}
+	return usable
+}
+
+// addrTypes returns the address record types to look up for the Family of c.
+func (c *Client) addrTypes() []uint16 {
+	switch c.Family {
+	case 4:
+		return []uint16{dns.TypeA}
+	case 6:
+		return []uint16{dns.TypeAAAA}
+	}
+	return []uint16{dns.TypeA, dns.TypeAAAA}
+}
+
+// UsableFamilies reports whether the host has a route to IPv4 and IPv6
+// destinations. No packet is sent.
+func UsableFamilies() (v4, v6 bool) {
+	usable := func(addr string) bool {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	// Destinations are the a.root-servers.net addresses.
+	return usable("198.41.0.4:53"), usable("[2001:503:ba3e::2:30]:53")
+}
+
 func domainEqual(d1, d2 string) bool {
 	return strings.ToLower(dns.Fqdn(d1)) == strings.ToLower(dns.Fqdn(d2))
 }
 
+// exchange sends m to addr of s over network and waits for the response using Exchanger if
+// set, or dialing through DialContext if set. It also returns the source port
+// of the query when known.
+func (c *Client) exchange(ctx context.Context, m *dns.Msg, s Server, addr, network string) (*dns.Msg, time.Duration, int, error) {
+	hostport := net.JoinHostPort(addr, port(network))
+	if c.Exchanger != nil {
+		r, rtt, err := c.Exchanger.ExchangeContext(ctx, m, hostport)
+		if r == nil && err == nil {
+			err = ErrNoResponse
+		}
+		return r, rtt, 0, err
+	}
+	dc := c.dnsClient(s, network)
+	var conn net.Conn
+	if c.DialContext == nil {
+		dconn, err := dc.DialContext(ctx, hostport)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		conn = dconn.Conn
+	} else {
+		dialNet := "udp"
+		if stream(network) {
+			dialNet = "tcp"
+		}
+		var err error
+		if conn, err = c.DialContext(ctx, dialNet, hostport); err != nil {
+			return nil, 0, 0, err
+		}
+		if network == "tcp-tls" {
+			conn = tls.Client(conn, dc.TLSConfig)
+		}
+	}
+	defer conn.Close()
+	if err := c.setBuffers(conn); err != nil {
+		return nil, 0, 0, err
+	}
+	// ExchangeWithConn does not take a context: unblock it when ctx is done.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	r, rtt, err := dc.ExchangeWithConn(m, &dns.Conn{Conn: conn, UDPSize: dc.UDPSize}) // nolint: exhaustruct
+	return r, rtt, localPort(conn), err
+}
+
+// setBuffers applies ReadBuffer and WriteBuffer to conn, or to the connection
+// it wraps for TLS.
+func (c *Client) setBuffers(conn net.Conn) error {
+	if c.ReadBuffer == 0 && c.WriteBuffer == 0 {
+		return nil
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	bc, ok := conn.(interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	})
+	if !ok {
+		return nil
+	}
+	if c.ReadBuffer > 0 {
+		if err := bc.SetReadBuffer(c.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if c.WriteBuffer > 0 {
+		return bc.SetWriteBuffer(c.WriteBuffer)
+	}
+	return nil
+}
+
+// localPort returns the local port of conn, or 0 if unknown.
+func localPort(conn net.Conn) int {
+	switch a := conn.LocalAddr().(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+// transports returns the networks to try in order for each exchange.
+func (c *Client) transports() []string {
+	if len(c.Transports) > 0 {
+		return c.Transports
+	}
+	if c.Net == "" {
+		return []string{"udp"}
+	}
+	return []string{c.Net}
+}
+
+// fallback returns true if r calls for trying the next transport: the
+// response is truncated or the exchange timed out.
+func fallback(r Response) bool {
+	var nerr net.Error
+	if errors.As(r.Err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return r.Err == nil && r.Msg.Truncated
+}
+
+// stream returns true if network is a stream transport (TCP or TLS).
+func stream(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
+
+// mixCase returns name with the case of each letter randomized.
+func mixCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.Intn(2) == 0 { // nolint: gosec
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
+
+// questionMatch returns true if the question of r is the one of q. Error
+// responses may omit the question.
+func questionMatch(q, r *dns.Msg) bool {
+	if len(r.Question) == 0 {
+		return r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError
+	}
+	if len(r.Question) != len(q.Question) {
+		return false
+	}
+	for i, rq := range r.Question {
+		qq := q.Question[i]
+		if !domainEqual(rq.Name, qq.Name) || rq.Qtype != qq.Qtype || rq.Qclass != qq.Qclass {
+			return false
+		}
+	}
+	return true
+}
+
+// deniesZone returns true if r is a NXDOMAIN response denying the existence
+// of zone itself, either for the zone apex or with the SOA of a parent zone.
+func deniesZone(r *dns.Msg, zone string) bool {
+	if r == nil || r.Rcode != dns.RcodeNameError || len(r.Question) == 0 {
+		return false
+	}
+	if domainEqual(r.Question[0].Name, zone) {
+		return true
+	}
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return len(soa.Hdr.Name) < len(zone) && dns.IsSubDomain(soa.Hdr.Name, zone)
+		}
+	}
+	return false
+}
+
+// oversized returns true if r exceeds MaxResponseSize.
+func (c *Client) oversized(r *dns.Msg) bool {
+	return c.MaxResponseSize > 0 && r != nil && r.Len() > c.MaxResponseSize
+}
+
+// port returns the server port for the transport of c.
+func port(network string) string {
+	if network == "tcp-tls" {
+		return "853"
+	}
+	return "53"
+}
+
+// dnsClient returns the dns.Client to use to query s over network. With DNS
+// over TLS, the certificate is verified against the name of s.
+func (c *Client) dnsClient(s Server, network string) *dns.Client {
+	if (network == c.Net && network != "tcp-tls") || (network == "udp" && c.Net == "") {
+		return &c.Client
+	}
+	dc := &dns.Client{ // nolint: exhaustruct
+		Net:          network,
+		UDPSize:      c.UDPSize,
+		Dialer:       c.Dialer,
+		Timeout:      c.Timeout,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+	}
+	if network == "tcp-tls" {
+		cfg := &tls.Config{} // nolint: gosec,exhaustruct
+		if c.TLSConfig != nil {
+			cfg = c.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" && net.ParseIP(s.Name) == nil {
+			cfg.ServerName = strings.TrimSuffix(s.Name, ".")
+		}
+		dc.TLSConfig = cfg
+	}
+	return dc
+}
+
+// requestKeepalive adds an empty EDNS0 TCP keepalive option to m if it has
+// an OPT record, asking the server to advertise its idle timeout.
+func requestKeepalive(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE}) // nolint: exhaustruct
+}
+
+// keepalive returns the idle timeout advertised in r, or zero.
+func keepalive(r *dns.Msg) time.Duration {
+	if r == nil {
+		return 0
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	for _, o := range opt.Option {
+		if k, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			return time.Duration(k.Timeout) * 100 * time.Millisecond
+		}
+	}
+	return 0
+}
+
 // RecursiveQuery performs a recursive query by querying all the available name
 // servers to gather statistics.
-// nolint: funlen,gocyclo,gocognit,nonamedreturns,varnamelen
+// nolint: nonamedreturns
 func (c *Client) RecursiveQuery(m *dns.Msg, tracer Tracer) (r *dns.Msg, rtt time.Duration, err error) {
-	// TODO: check m got a single question
+	return c.RecursiveQueryContext(context.Background(), m, tracer)
+}
+
+// RecursiveQueryContext is like RecursiveQuery but stops and returns ctx's
+// error as soon as ctx is done. Steps completed before that are still reported
+// to the tracer.
+// nolint: nonamedreturns
+func (c *Client) RecursiveQueryContext(ctx context.Context, m *dns.Msg, tracer Tracer) (r *dns.Msg, rtt time.Duration, err error) {
+	r, rtt, _, err = c.recursiveQuery(ctx, m, tracer, true)
+	return r, rtt, err
+}
+
+// AuthoritativeNS walks the delegations down to the zone name belongs to and
+// returns its name servers with their glue or resolved addresses. CNAMEs are
+// not followed: the zone holding the CNAME is returned.
+func (c *Client) AuthoritativeNS(name string) ([]Server, error) {
+	_, servers, err := c.Delegation(context.Background(), name)
+	return servers, err
+}
+
+// Delegation is like AuthoritativeNS but also returns the name of the zone
+// and stops when ctx is done.
+// nolint: nonamedreturns
+func (c *Client) Delegation(ctx context.Context, name string) (zone string, servers []Server, err error) {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), dns.TypeNS)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	// Traced queries keep all the NS of each delegation.
+	t := Tracer{GotIntermediaryResponse: func(_ int, _ *dns.Msg, rs Responses, _ ResponseType) { // nolint: exhaustruct
+		if len(rs) > 0 {
+			zone = rs[0].Zone
+		}
+	}}
+	_, _, servers, err = c.recursiveQuery(ctx, m, t, false)
+	return zone, servers, err
+}
+
+// recursiveQuery implements RecursiveQueryContext and also returns the servers
+// queried at the last step. If followCNAME is false, a CNAME response ends the
+// query.
+// nolint: funlen,gocyclo,gocognit,nonamedreturns,varnamelen
+func (c *Client) recursiveQuery(ctx context.Context, m *dns.Msg, tracer Tracer, followCNAME bool) (r *dns.Msg, rtt time.Duration, servers []Server, err error) {
+	if len(m.Question) != 1 {
+		return nil, 0, nil, fmt.Errorf("%w, got %d", ErrQuestionCount, len(m.Question))
+	}
+	if m.Opcode != dns.OpcodeQuery {
+		return nil, 0, nil, fmt.Errorf("%w, got %s", ErrNotQuery, dns.OpcodeToString[m.Opcode])
+	}
 	m = m.Copy()
 	qname := m.Question[0].Name
 	qtype := m.Question[0].Qtype
-	zone := "."
-	for i := 1; i < 100; i++ {
-		_, servers := c.DCache.Get(qname)
-
-		// Resolve servers name if needed.
-		wg := &sync.WaitGroup{}
-		for i, s := range servers {
-			if len(s.Addrs) == 0 {
-				wg.Add(1)
-				go func(s *Server) {
-					var err error
-					lm := m.Copy()
-					lm.SetQuestion(s.Name, 0) // qtypes are set by lookup host
-					s.Addrs, s.LookupRTT = c.lookupHost(lm)
-					if err != nil {
-						s.LookupErr = err
-					}
-					wg.Done()
-				}(&servers[i])
-			}
+	dcache := &c.DCache
+	if c.NoCache {
+		// Only read back delegations learned during this query.
+		c.DCache.mu.Lock()
+		dcache = &DelegationCache{MaxServers: c.DCache.MaxServers, Roots: c.DCache.Roots}
+		c.DCache.mu.Unlock()
+	}
+	// Topmost delegation followed without DS record in the current branch:
+	// zones below it are unsigned and cannot be authenticated.
+	var insecure string
+	dnssec := m.IsEdns0() != nil && m.IsEdns0().Do()
+	// Delegation that could not be cached, used for the next step anyway.
+	var nextZone string
+	var nextServers []Server
+	for i := 1; i < maxSteps; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, rtt, servers, err
+		}
+		var zone string
+		zone, servers = dcache.Get(qname)
+		if nextZone != "" && len(nextZone) >= len(zone) && dns.IsSubDomain(nextZone, qname) {
+			zone, servers = nextZone, append([]Server(nil), nextServers...)
+		}
+		nextZone, nextServers = "", nil
+		if ov, found := c.Overrides[zone]; found {
+			c.debug("overriding zone servers", "zone", zone, "servers", len(ov))
+			servers = append([]Server(nil), ov...)
+		}
+		if c.MaxServersPerStep > 0 && len(servers) > c.MaxServersPerStep {
+			// Prefer servers not requiring a name lookup.
+			sort.SliceStable(servers, func(i, j int) bool {
+				return len(servers[i].Addrs) > 0 && len(servers[j].Addrs) == 0
+			})
+			servers = servers[:c.MaxServersPerStep]
 		}
-		wg.Wait()
+		c.debug("querying zone", "step", i, "qname", qname, "qtype", dns.TypeToString[qtype], "zone", zone, "servers", len(servers))
 
 		m.Question[0].Name = qname
-		rs := c.ParallelQuery(m, servers)
+		var rs Responses
+		cached := false
+		if c.ACache != nil && !c.NoCache {
+			rs, cached = c.ACache.Get(zone, qname, qtype)
+		}
+		if !cached {
+			c.resolveServers(ctx, m, servers)
+			rs = c.parallelQuery(ctx, m, servers, tracer.OnWire)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, rtt, servers, err
+		}
+		for i := range rs {
+			rs[i].Zone = zone
+			if rs[i].Err == nil && zone != "." && deniesZone(rs[i].Msg, zone) {
+				rs[i].Err = fmt.Errorf("%w: NXDOMAIN for %s", ErrBrokenDelegation, zone)
+				tracer.warn("%s: broken delegation, %s(%s) answers NXDOMAIN for the zone", zone, rs[i].Server.Name, rs[i].Addr)
+			}
+			if errors.Is(rs[i].Err, ErrMalformed) {
+				tracer.warn("%s(%s): malformed response ignored", rs[i].Server.Name, rs[i].Addr)
+			}
+			if errors.Is(rs[i].Err, ErrCaseMismatch) {
+				tracer.warn("%s(%s): response does not echo the 0x20 query name case, possibly spoofed", rs[i].Server.Name, rs[i].Addr)
+			}
+			if c.oversized(rs[i].Msg) {
+				tracer.warn("%s(%s): response of %d bytes exceeds the %d bytes limit", rs[i].Server.Name, rs[i].Addr, rs[i].Msg.Len(), c.MaxResponseSize)
+			}
+			if rs[i].Err == nil && rs[i].Msg.AuthenticatedData && insecure != "" && dns.IsSubDomain(insecure, zone) {
+				tracer.warn("%s(%s): AD bit set for %s but the delegation of %s is unsigned", rs[i].Server.Name, rs[i].Addr, zone, insecure)
+			}
+		}
+		if c.ACache != nil && !cached {
+			c.ACache.Set(zone, qname, qtype, rs)
+		}
 
 		var r *dns.Msg
 		fr := rs.Fastest()
+		if fr.Msg != nil && c.retryRcode(fr.Msg.Rcode) {
+			for _, rr := range rs.Ranked() {
+				if !c.retryRcode(rr.Msg.Rcode) {
+					tracer.warn("%s(%s): %s, using the response of %s(%s)", fr.Server.Name, fr.Addr,
+						dns.RcodeToString[fr.Msg.Rcode], rr.Server.Name, rr.Addr)
+					fr = &rr
+					break
+				}
+			}
+		}
 		if fr != nil {
 			r = fr.Msg
 		}
 		if r == nil {
+			c.debug("no server answered", "qname", qname, "zone", zone)
 			if len(rs) > 0 {
-				return rs[0].Msg, rtt + rs[0].RTT, rs[0].Err
+				return rs[0].Msg, rtt + rs[0].RTT, servers, rs[0].Err
 			}
-			return nil, rtt, errors.New("no response")
+			return nil, rtt, servers, ErrNoResponse
 		}
 		rtt += fr.Server.LookupRTT + fr.RTT
 
 		var rtype ResponseType
-		var cname string
-		for _, rr := range r.Answer {
-			if domainEqual(rr.Header().Name, qname) && rr.Header().Rrtype == qtype {
-				rtype = ResponseTypeFinal
+		// CNAME hops of the response, from the queried name.
+		var hops [][2]string
+		// Follow the chain from qname, in as many passes as records in case
+		// they are out of order.
+	chain:
+		for range r.Answer {
+			progress := false
+			for _, rr := range r.Answer {
+				if !domainEqual(rr.Header().Name, qname) {
+					continue
+				}
+				if rr.Header().Rrtype == qtype {
+					// Also true for a CNAME when CNAME is the requested type.
+					rtype = ResponseTypeFinal
+					break chain
+				} else if rr.Header().Rrtype == dns.TypeCNAME {
+					hops = append(hops, [2]string{rr.Header().Name, rr.(*dns.CNAME).Target})
+					qname = rr.(*dns.CNAME).Target
+					rtype = ResponseTypeCNAME
+					progress = true
+				}
+			}
+			if !progress {
 				break
-			} else if rr.Header().Rrtype == dns.TypeCNAME {
-				cname = rr.Header().Name
-				qname = rr.(*dns.CNAME).Target
-				zone = "."
-				rtype = ResponseTypeCNAME
+			}
+		}
+		if rtype == ResponseTypeUnknown && qtype != dns.TypeNS {
+			// Some broken servers return the answer in the authority section.
+			var misplaced []dns.RR
+			for _, rr := range r.Ns {
+				if domainEqual(rr.Header().Name, qname) && rr.Header().Rrtype == qtype {
+					misplaced = append(misplaced, rr)
+				}
+			}
+			if len(misplaced) > 0 {
+				tracer.warn("%s: %s %s returned in the authority section instead of the answer section",
+					fr.Server.Name, qname, dns.TypeToString[qtype])
+				r = r.Copy()
+				r.Answer = append(r.Answer, misplaced...)
+				rtype = ResponseTypeFinal
 			}
 		}
 		if rtype == ResponseTypeUnknown {
 			for _, ns := range r.Ns {
 				if ns, ok := ns.(*dns.NS); ok && len(ns.Header().Name) > len(zone) {
 					rtype = ResponseTypeDelegation
-					zone = ns.Header().Name
 					break
 				}
 			}
@@ -171,32 +1019,50 @@ func (c *Client) RecursiveQuery(m *dns.Msg, tracer Tracer) (r *dns.Msg, rtt time
 			}
 		}
 
+		if rtype == ResponseTypeDelegation && (c.Strict || c.StrictAbort) {
+			var violation string
+			for _, sr := range rs {
+				if sr.Err != nil {
+					continue
+				}
+				for _, v := range ReferralViolations(sr.Msg, zone) {
+					tracer.warn("%s(%s): strict: %s", sr.Server.Name, sr.Addr, v)
+					if violation == "" {
+						violation = fmt.Sprintf("%s from %s(%s)", v, sr.Server.Name, sr.Addr)
+					}
+				}
+			}
+			if violation != "" && c.StrictAbort {
+				if tracer.GotIntermediaryResponse != nil {
+					tracer.GotIntermediaryResponse(i, m.Copy(), rs, rtype)
+				}
+				return r, rtt, servers, fmt.Errorf("%w: %s", ErrStrictReferral, violation)
+			}
+		}
+
 		if rtype == ResponseTypeDelegation {
-			for _, ns := range r.Ns {
-				ns, ok := ns.(*dns.NS)
-				if !ok {
-					continue // skip DS records
+			name, nss := ParseDelegation(r)
+			c.debug("delegation", "zone", name, "servers", len(nss), "from", fr.Server.Name)
+			if dnssec && (insecure == "" || !dns.IsSubDomain(insecure, name)) && !hasDS(r, name) {
+				insecure = name
+			}
+			for n, s := range nss {
+				if c.MaxDelegationServers > 0 && n >= c.MaxDelegationServers {
+					tracer.warn("%s: delegation truncated to %d name servers", name, n)
+					break
 				}
-				name := ns.Header().Name
-				var addrs []string
-				for _, rr := range r.Extra {
-					if domainEqual(rr.Header().Name, ns.Ns) {
-						switch a := rr.(type) {
-						case *dns.A:
-							addrs = append(addrs, a.A.String())
-						case *dns.AAAA:
-							addrs = append(addrs, a.AAAA.String())
-						}
+				if _, full := dcache.add(name, s); full {
+					tracer.warn("%s: delegation cache full, not caching the delegation", name)
+					nextZone, nextServers = strings.ToLower(name), nss
+					if c.MaxDelegationServers > 0 && len(nss) > c.MaxDelegationServers {
+						nextServers = nss[:c.MaxDelegationServers]
 					}
+					break
 				}
-				s := Server{
-					Name:    ns.Ns,
-					HasGlue: len(addrs) > 0,
-					TTL:     ns.Header().Ttl,
-					Addrs:   addrs,
+				if dcache != &c.DCache {
+					c.DCache.Add(name, s)
 				}
-				c.DCache.Add(name, s)
-				c.LCache.Set(s.Name, s.Addrs)
+				c.LCache.SetGlue(s.Name, s.Addrs, s.TTL)
 				if tracer.GotIntermediaryResponse == nil {
 					// If not traced, only take first NS.
 					break
@@ -210,58 +1076,302 @@ func (c *Client) RecursiveQuery(m *dns.Msg, tracer Tracer) (r *dns.Msg, rtt time
 
 		switch rtype {
 		case ResponseTypeCNAME:
-			if tracer.FollowingCNAME != nil {
-				tracer.FollowingCNAME(cname, qname)
+			if !followCNAME {
+				return r, rtt, servers, nil
+			}
+			for _, hop := range hops {
+				c.debug("following CNAME", "name", hop[0], "target", hop[1])
+				if tracer.FollowingCNAME != nil {
+					tracer.FollowingCNAME(hop[0], hop[1])
+				}
 			}
 		case ResponseTypeFinal:
-			return r, rtt, nil
+			if name := c.ENTEvidence(qname, r); name != "" {
+				tracer.warn("%s: NXDOMAIN from %s but %s exists below it: possible server bug, an empty non-terminal should answer NODATA", qname, fr.Server.Name, name)
+			}
+			return r, rtt, servers, nil
+		}
+	}
+	return nil, rtt, servers, fmt.Errorf("%w: %d", ErrTooManySteps, maxSteps-1)
+}
+
+// hasDS returns true if the referral r carries a DS record for zone.
+func hasDS(r *dns.Msg, zone string) bool {
+	for _, rr := range r.Ns {
+		if rr.Header().Rrtype == dns.TypeDS && domainEqual(rr.Header().Name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveServers drops the addresses of servers not matching Family and looks
+// up the addresses of servers left without any, in parallel, using queries
+// derived from m.
+func (c *Client) resolveServers(ctx context.Context, m *dns.Msg, servers []Server) {
+	wg := &sync.WaitGroup{}
+	for i := range servers {
+		if servers[i].Addrs = c.familyAddrs(servers[i].Addrs); len(servers[i].Addrs) == 0 {
+			wg.Add(1)
+			go func(s *Server) {
+				lm := m.Copy()
+				lm.SetQuestion(s.Name, 0) // qtypes are set by lookup host
+				s.Addrs, s.LookupRTT = c.lookupHost(ctx, lm)
+				wg.Done()
+			}(&servers[i])
+		}
+	}
+	wg.Wait()
+}
+
+// QueryZone sends m to all the servers of zone and returns their raw
+// responses. Servers come from DCache, walking the delegations down to zone
+// first if it is not cached, and their names are resolved as needed. Referrals
+// and CNAMEs in the responses are not followed.
+func (c *Client) QueryZone(zone string, m *dns.Msg) (Responses, error) {
+	return c.QueryZoneContext(context.Background(), zone, m)
+}
+
+// QueryZoneContext is like QueryZone but aborts pending exchanges when ctx is
+// done.
+func (c *Client) QueryZoneContext(ctx context.Context, zone string, m *dns.Msg) (Responses, error) {
+	zone = dns.CanonicalName(zone)
+	label, servers := c.DCache.Get(zone)
+	if label != zone {
+		var err error
+		if label, servers, err = c.Delegation(ctx, zone); err != nil {
+			return nil, err
+		}
+		if !domainEqual(label, zone) {
+			return nil, fmt.Errorf("%w: %s", ErrNotDelegated, zone)
+		}
+	}
+	if ov, found := c.Overrides[zone]; found {
+		servers = append([]Server(nil), ov...)
+	}
+	c.resolveServers(ctx, m, servers)
+	rs := c.ParallelQueryContext(ctx, m, servers)
+	for i := range rs {
+		rs[i].Zone = zone
+	}
+	return rs, ctx.Err()
+}
+
+// Plan returns the zone and servers a query for qname would start from given
+// the current state of the caches, without sending any query. Servers without
+// glue get the addresses found in LCache, if any.
+func (c *Client) Plan(qname string) (zone string, servers []Server) {
+	zone, servers = c.DCache.Get(qname)
+	for i, s := range servers {
+		if len(s.Addrs) > 0 {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			servers[i].Addrs = append(servers[i].Addrs, c.LCache.Get(s.Name, qtype).Addresss...)
+		}
+	}
+	return zone, servers
+}
+
+// ParseDelegation returns the delegated zone and its name servers with glue
+// addresses found in the referral response r.
+func ParseDelegation(r *dns.Msg) (zone string, servers []Server) {
+	for _, ns := range r.Ns {
+		ns, ok := ns.(*dns.NS)
+		if !ok {
+			continue // skip DS records
+		}
+		zone = ns.Header().Name
+		var addrs []string
+		for _, rr := range r.Extra {
+			if domainEqual(rr.Header().Name, ns.Ns) {
+				switch a := rr.(type) {
+				case *dns.A:
+					addrs = append(addrs, a.A.String())
+				case *dns.AAAA:
+					addrs = append(addrs, a.AAAA.String())
+				}
+			}
+		}
+		hasGlue := len(addrs) > 0
+		if !hasGlue {
+			addrs = svcbHints(r.Extra, ns.Ns)
+		}
+		servers = append(servers, Server{
+			Name:    ns.Ns,
+			HasGlue: hasGlue,
+			TTL:     ns.Header().Ttl,
+			Addrs:   addrs,
+			Hinted:  !hasGlue && len(addrs) > 0,
+		})
+	}
+	return zone, servers
+}
+
+// svcbHints returns the ipv4hint and ipv6hint addresses of the SVCB records of
+// extra owned by name or by its _dns service name (RFC 9461).
+func svcbHints(extra []dns.RR, name string) (addrs []string) {
+	for _, rr := range extra {
+		svcb, ok := rr.(*dns.SVCB)
+		if !ok || !(domainEqual(svcb.Hdr.Name, name) || domainEqual(svcb.Hdr.Name, "_dns."+name)) {
+			continue
+		}
+		for _, kv := range svcb.Value {
+			switch h := kv.(type) {
+			case *dns.SVCBIPv4Hint:
+				for _, ip := range h.Hint {
+					addrs = append(addrs, ip.String())
+				}
+			case *dns.SVCBIPv6Hint:
+				for _, ip := range h.Hint {
+					addrs = append(addrs, ip.String())
+				}
+			}
 		}
 	}
-	return nil, rtt, nil
+	return addrs
+}
+
+// LookupHost resolves the A and AAAA addresses of host, starting from the most
+// specific delegation available in the cache.
+// nolint: nonamedreturns
+func (c *Client) LookupHost(host string) (addrs []string, rtt time.Duration) {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(host), 0) // qtypes are set by lookup host
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	return c.lookupHost(context.Background(), m)
 }
 
 // nolint: nonamedreturns,varnamelen
-func (c *Client) lookupHost(m *dns.Msg) (addrs []string, rtt time.Duration) {
+func (c *Client) lookupHost(ctx context.Context, m *dns.Msg) (addrs []string, rtt time.Duration) {
 	qname := m.Question[0].Name
-	aa := c.LCache.Get(qname)
-	if len(aa.Addresss) != 0 || aa.RetryCount > c.maxRetryCount {
-		return aa.Addresss, 0
-	}
-	c.LCache.IncAttempt(qname)
-	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
-	rs := make(chan Response)
-	for _, qtype := range qtypes {
+	rs := make(chan Response, 2)
+	pending := 0
+	for _, qtype := range c.addrTypes() {
+		aa := c.LCache.Get(qname, qtype)
+		if aa.RetryCount > c.maxRetryCount || (aa.Resolved && !c.NoCache) {
+			c.debug("lookup cache hit", "name", qname, "qtype", dns.TypeToString[qtype], "addrs", aa.Addresss, "resolved", aa.Resolved)
+			addrs = append(addrs, aa.Addresss...)
+			continue
+		}
+		if aa.RetryCount > 0 {
+			c.debug("lookup retried", "name", qname, "qtype", dns.TypeToString[qtype], "attempt", aa.RetryCount+1)
+		} else {
+			c.debug("lookup cache miss", "name", qname, "qtype", dns.TypeToString[qtype])
+		}
+		c.LCache.incAttempt(qname, qtype, c.NoCache)
+		pending++
 		m := m.Copy()
 		m.Question[0].Qtype = qtype
-		go func() {
-			r, rtt, err := c.RecursiveQuery(m, Tracer{}) // nolint: exhaustruct,govet
+		delay := c.retryDelay(aa)
+		go func(qtype uint16) {
+			if delay > 0 {
+				t := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+				case <-t.C:
+				}
+			}
+			r, rtt, err := c.RecursiveQueryContext(ctx, m, Tracer{}) // nolint: exhaustruct,govet
+			if err == nil && r != nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) {
+				c.LCache.Set(qname, qtype, answerAddrs(r), answerTTL(r))
+			} else {
+				c.debug("lookup failed", "name", qname, "qtype", dns.TypeToString[qtype], "err", lookupErr(r, err))
+			}
 			rs <- Response{
 				Msg: r,
 				Err: err,
 				RTT: rtt,
 			}
-		}()
+		}(qtype)
 	}
-	for range qtypes {
-		r := <-rs
-		if r.Err != nil {
-			return nil, 0
+	for ; pending > 0; pending-- {
+		if c.FastLookup && len(addrs) > 0 {
+			// The pending family is cached when it arrives.
+			break
 		}
+		r := <-rs
 		if r.RTT > rtt {
 			rtt = r.RTT // get the longest of the two // queries
 		}
-		if r.Msg == nil {
-			continue
+		if r.Err == nil {
+			addrs = append(addrs, answerAddrs(r.Msg)...)
 		}
-		for _, rr := range r.Msg.Answer {
-			switch rr := rr.(type) {
-			case *dns.A:
-				addrs = append(addrs, rr.A.String())
-			case *dns.AAAA:
-				addrs = append(addrs, rr.AAAA.String())
+	}
+	return addrs, rtt
+}
+
+// retryDelay returns the backoff to wait before a new lookup attempt given
+// the previous attempts of aa.
+func (c *Client) retryDelay(aa AddressAttempt) time.Duration {
+	if c.RetryBackoff <= 0 || aa.Resolved || aa.RetryCount == 0 {
+		return 0
+	}
+	shift := aa.RetryCount - 1
+	if shift > 10 {
+		shift = 10
+	}
+	d := c.RetryBackoff << shift
+	return d + time.Duration(rand.Int63n(int64(d)/2+1)) // nolint: gosec
+}
+
+// debug logs msg with args at debug level if c has a Logger.
+func (c *Client) debug(msg string, args ...any) {
+	if c.Logger != nil {
+		c.Logger.Debug(msg, args...)
+	}
+}
+
+// lookupErr describes why a lookup returning r and err failed.
+func lookupErr(r *dns.Msg, err error) string {
+	switch {
+	case err != nil:
+		return err.Error()
+	case r == nil:
+		return "no response"
+	default:
+		return dns.RcodeToString[r.Rcode]
+	}
+}
+
+// answerTTL returns the lowest TTL of the answer of m, or its negative caching
+// TTL (RFC 2308) if it has no answer.
+func answerTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+	for _, rr := range m.Answer {
+		if t := rr.Header().Ttl; !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	if found {
+		return ttl
+	}
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
 			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return 0
+}
+
+// answerAddrs returns the A and AAAA addresses found in the answer section of
+// m.
+func answerAddrs(m *dns.Msg) (addrs []string) {
+	if m == nil {
+		return nil
+	}
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
 		}
 	}
-	c.LCache.Set(qname, addrs)
-	return
+	return addrs
 }
@@ -0,0 +1,336 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecursiveQueryNotQuery(t *testing.T) {
+	c, e := newMockClient(exampleHandlers())
+	m := query("example.", dns.TypeSOA)
+	m.Opcode = dns.OpcodeNotify
+	if _, _, err := c.RecursiveQuery(m, Tracer{}); !errors.Is(err, ErrNotQuery) {
+		t.Errorf("err = %v, want ErrNotQuery", err)
+	}
+	if qs := e.Queries(); len(qs) > 0 {
+		t.Errorf("NOTIFY sent to %v", qs)
+	}
+}
+
+func TestRecursiveQueryQuestionCount(t *testing.T) {
+	c, e := newMockClient(exampleHandlers())
+	for _, m := range []*dns.Msg{
+		{},
+		{Question: []dns.Question{{Name: "a.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, {Name: "b.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}},
+	} {
+		if _, _, err := c.RecursiveQuery(m, Tracer{}); !errors.Is(err, ErrQuestionCount) {
+			t.Errorf("%d questions: err = %v, want ErrQuestionCount", len(m.Question), err)
+		}
+	}
+	if qs := e.Queries(); len(qs) > 0 {
+		t.Errorf("queries sent: %v", qs)
+	}
+}
+
+// parallelQueryErrs sends a query for www.example. A to a server answering
+// with forge and to one answering normally, and returns the error of each
+// response by address.
+func parallelQueryErrs(forge func(r *dns.Msg)) map[string]error {
+	const goodAddr = "192.0.2.11"
+	good := exampleHandlers()[mockExampleAddr]
+	handlers := map[string]mockHandler{
+		mockExampleAddr: func(m *dns.Msg) *dns.Msg {
+			r := good(m)
+			forge(r)
+			return r
+		},
+		goodAddr: good,
+	}
+	c, _ := newMockClient(handlers)
+	rs := c.ParallelQuery(query("www.example.", dns.TypeA), []Server{
+		{Name: "ns1.example.", HasGlue: true, Addrs: []string{mockExampleAddr}},
+		{Name: "ns2.example.", HasGlue: true, Addrs: []string{goodAddr}},
+	})
+	errs := map[string]error{}
+	for _, r := range rs {
+		errs[r.Addr] = r.Err
+	}
+	return errs
+}
+
+func TestParallelQueryQuestionMismatch(t *testing.T) {
+	for name, forge := range map[string]func(r *dns.Msg){
+		"name":  func(r *dns.Msg) { r.Question[0].Name = "evil.example." },
+		"type":  func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeAAAA },
+		"class": func(r *dns.Msg) { r.Question[0].Qclass = dns.ClassCHAOS },
+		"count": func(r *dns.Msg) { r.Question = append(r.Question, r.Question[0]) },
+	} {
+		errs := parallelQueryErrs(forge)
+		if !errors.Is(errs[mockExampleAddr], ErrQuestionMismatch) {
+			t.Errorf("%s: err = %v, want ErrQuestionMismatch", name, errs[mockExampleAddr])
+		}
+		if err := errs["192.0.2.11"]; err != nil {
+			t.Errorf("%s: matching response err = %v", name, err)
+		}
+	}
+}
+
+func TestParallelQueryQuestionCase(t *testing.T) {
+	errs := parallelQueryErrs(func(r *dns.Msg) { r.Question[0].Name = "WWW.Example." })
+	if err := errs[mockExampleAddr]; err != nil {
+		t.Errorf("err = %v, want case insensitive match", err)
+	}
+}
+
+func TestParallelQueryIDMismatch(t *testing.T) {
+	errs := parallelQueryErrs(func(r *dns.Msg) { r.Id++ })
+	if !errors.Is(errs[mockExampleAddr], ErrIDMismatch) {
+		t.Errorf("err = %v, want ErrIDMismatch", errs[mockExampleAddr])
+	}
+	if err := errs["192.0.2.11"]; err != nil {
+		t.Errorf("matching response err = %v", err)
+	}
+}
+
+func TestRecursiveQueryIgnoresForgedID(t *testing.T) {
+	const forgedAddr = "192.0.2.12"
+	handlers := exampleHandlers()
+	handlers[mockRootAddr] = func(m *dns.Msg) *dns.Msg {
+		r := referral(m, "example.", "ns1.example.", mockExampleAddr)
+		r.Ns = append(r.Ns, rr("example. 3600 IN NS ns2.example."))
+		r.Extra = append(r.Extra, rr("ns2.example. 3600 IN A "+forgedAddr))
+		return r
+	}
+	handlers[forgedAddr] = func(m *dns.Msg) *dns.Msg {
+		r := reply(m, "www.example. 300 IN A 203.0.113.66")
+		r.Id ^= 0xffff
+		return r
+	}
+	c, _ := newMockClient(handlers)
+	r, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), Tracer{GotIntermediaryResponse: func(int, *dns.Msg, Responses, ResponseType) {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("answer = %v, want the one of ns1.example.", r.Answer)
+	}
+}
+
+func TestRecursiveQueryAnswerInAuthority(t *testing.T) {
+	handlers := exampleHandlers()
+	handlers[mockExampleAddr] = func(m *dns.Msg) *dns.Msg {
+		r := reply(m)
+		r.Ns = append(r.Ns, rr("www.example. 300 IN A 198.51.100.1"))
+		return r
+	}
+	c, _ := newMockClient(handlers)
+	var rtypes []ResponseType
+	var warnings []string
+	tracer := Tracer{
+		GotIntermediaryResponse: func(_ int, _ *dns.Msg, _ Responses, rtype ResponseType) { rtypes = append(rtypes, rtype) },
+		Warning:                 func(msg string) { warnings = append(warnings, msg) },
+	}
+	r, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("answer = %v, want the A record of the authority section", r.Answer)
+	}
+	if len(rtypes) != 2 || rtypes[1] != ResponseTypeFinal {
+		t.Errorf("response types = %v, want a final last step", rtypes)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("warnings = %q, want one about the authority section", warnings)
+	}
+}
+
+func TestDeniesZone(t *testing.T) {
+	nx := func(qname string, soa string) *dns.Msg {
+		r := reply(query(qname, dns.TypeA))
+		r.Rcode = dns.RcodeNameError
+		if soa != "" {
+			r.Ns = append(r.Ns, rr(soa+" 300 IN SOA ns. host. 1 2 3 4 5"))
+		}
+		return r
+	}
+	tests := []struct {
+		name string
+		r    *dns.Msg
+		want bool
+	}{
+		{"nil", nil, false},
+		{"apex", nx("example.", "example."), true},
+		{"parent SOA", nx("www.example.", "."), true},
+		{"zone SOA", nx("www.example.", "example."), false},
+		{"no SOA", nx("www.example.", ""), false},
+		{"NOERROR", reply(query("example.", dns.TypeA)), false},
+	}
+	for _, tt := range tests {
+		if got := deniesZone(tt.r, "example."); got != tt.want {
+			t.Errorf("%s: deniesZone = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecursiveQueryBrokenDelegation(t *testing.T) {
+	handlers := exampleHandlers()
+	handlers[mockExampleAddr] = func(m *dns.Msg) *dns.Msg {
+		r := reply(m)
+		r.Rcode = dns.RcodeNameError
+		r.Ns = append(r.Ns, rr(". 300 IN SOA a.root.test. host. 1 2 3 4 5"))
+		return r
+	}
+	c, _ := newMockClient(handlers)
+	var warnings []string
+	tracer := Tracer{Warning: func(msg string) { warnings = append(warnings, msg) }}
+	if _, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), tracer); !errors.Is(err, ErrBrokenDelegation) {
+		t.Errorf("err = %v, want ErrBrokenDelegation", err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("warnings = %q, want one broken delegation warning", warnings)
+	}
+
+	// A NXDOMAIN from the zone itself is a valid answer.
+	c, _ = newMockClient(exampleHandlers())
+	r, _, err := c.RecursiveQuery(query("nx.example.", dns.TypeA), Tracer{})
+	if err != nil || r.Rcode != dns.RcodeNameError {
+		t.Errorf("got %v, %v, want NXDOMAIN", r, err)
+	}
+}
+
+func TestRecursiveQueryCNAMEType(t *testing.T) {
+	handlers := exampleHandlers()
+	handlers[mockExampleAddr] = func(m *dns.Msg) *dns.Msg {
+		return reply(m, "www.example. 300 IN CNAME web.example.", "web.example. 300 IN A 198.51.100.1")
+	}
+	c, e := newMockClient(handlers)
+	var rtypes []ResponseType
+	tracer := Tracer{
+		GotIntermediaryResponse: func(_ int, _ *dns.Msg, _ Responses, rtype ResponseType) { rtypes = append(rtypes, rtype) },
+		FollowingCNAME:          func(domain, target string) { t.Errorf("following CNAME %s -> %s", domain, target) },
+	}
+	r, _, err := c.RecursiveQuery(query("www.example.", dns.TypeCNAME), tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) == 0 || r.Answer[0].(*dns.CNAME).Target != "web.example." {
+		t.Errorf("answer = %v, want the CNAME record", r.Answer)
+	}
+	if len(rtypes) != 2 || rtypes[1] != ResponseTypeFinal {
+		t.Errorf("response types = %v, want a final last step", rtypes)
+	}
+	if n := len(e.Queries()); n != 2 {
+		t.Errorf("%d queries, want 2", n)
+	}
+}
+
+func TestRecursiveQueryCNAMEHops(t *testing.T) {
+	const otherAddr = "192.0.2.30"
+	handlers := exampleHandlers()
+	handlers[mockRootAddr] = func(m *dns.Msg) *dns.Msg {
+		if dns.IsSubDomain("other.", m.Question[0].Name) {
+			return referral(m, "other.", "ns1.other.", otherAddr)
+		}
+		return referral(m, "example.", "ns1.example.", mockExampleAddr)
+	}
+	// Two hops in a single response, out of order.
+	handlers[mockExampleAddr] = func(m *dns.Msg) *dns.Msg {
+		return reply(m, "web.example. 300 IN CNAME www.other.", "www.example. 300 IN CNAME web.example.")
+	}
+	handlers[otherAddr] = func(m *dns.Msg) *dns.Msg {
+		return reply(m, "www.other. 300 IN A 198.51.100.3")
+	}
+	c, _ := newMockClient(handlers)
+	var hops []string
+	tracer := Tracer{FollowingCNAME: func(domain, target string) { hops = append(hops, domain+" "+target) }}
+	r, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("answer = %v, want www.other. A", r.Answer)
+	}
+	if want := []string{"www.example. web.example.", "web.example. www.other."}; !equalStrings(hops, want) {
+		t.Errorf("hops = %q, want %q", hops, want)
+	}
+}
+
+func TestFamilyAddrs(t *testing.T) {
+	v6only := []string{"2001:db8::1", "2001:db8::2"}
+	mixed := []string{"192.0.2.1", "2001:db8::1"}
+	tests := []struct {
+		family int
+		addrs  []string
+		want   []string
+		types  []uint16
+	}{
+		{0, v6only, v6only, []uint16{dns.TypeA, dns.TypeAAAA}},
+		{4, v6only, nil, []uint16{dns.TypeA}},
+		{6, v6only, v6only, []uint16{dns.TypeAAAA}},
+		{4, mixed, []string{"192.0.2.1"}, []uint16{dns.TypeA}},
+		{6, mixed, []string{"2001:db8::1"}, []uint16{dns.TypeAAAA}},
+	}
+	for _, tt := range tests {
+		c := &Client{Family: tt.family}
+		if got := c.familyAddrs(tt.addrs); !equalStrings(got, tt.want) {
+			t.Errorf("family %d: familyAddrs(%v) = %v, want %v", tt.family, tt.addrs, got, tt.want)
+		}
+		if got := c.addrTypes(); len(got) != len(tt.types) || got[0] != tt.types[0] {
+			t.Errorf("family %d: addrTypes() = %v, want %v", tt.family, got, tt.types)
+		}
+	}
+}
+
+func TestResolveServersIPv6Only(t *testing.T) {
+	const (
+		rootAddr    = "2001:db8::1"
+		exampleAddr = "2001:db8::10"
+	)
+	c, e := newMockClient(map[string]mockHandler{
+		rootAddr: func(m *dns.Msg) *dns.Msg {
+			return referral(m, "example.", "ns1.example.", exampleAddr)
+		},
+		exampleAddr: func(m *dns.Msg) *dns.Msg {
+			q := m.Question[0]
+			if q.Qtype == dns.TypeAAAA {
+				return reply(m, q.Name+" 300 IN AAAA 2001:db8::20")
+			}
+			return reply(m)
+		},
+	})
+	c.Family = 6
+	c.SetRoots([]Server{{Name: "a.root.test.", HasGlue: true, Addrs: []string{mockRootAddr, rootAddr}}})
+	servers := []Server{
+		{Name: "ns1.example.", HasGlue: true, Addrs: []string{exampleAddr}},
+		{Name: "ns2.example.", HasGlue: true, Addrs: []string{"192.0.2.20"}},
+		{Name: "ns3.example."},
+	}
+	c.resolveServers(context.Background(), query("www.example.", dns.TypeA), servers)
+	want := [][]string{{exampleAddr}, {"2001:db8::20"}, {"2001:db8::20"}}
+	for i, s := range servers {
+		if !equalStrings(s.Addrs, want[i]) {
+			t.Errorf("%s addrs = %v, want %v", s.Name, s.Addrs, want[i])
+		}
+	}
+	for _, q := range e.Queries() {
+		if addrFamily(q.Addr) != 6 || q.Question.Qtype != dns.TypeAAAA {
+			t.Errorf("query %s %s sent to %s with family 6", q.Question.Name, dns.TypeToString[q.Question.Qtype], q.Addr)
+		}
+	}
+}
+
+func TestQueryZoneContextCanceled(t *testing.T) {
+	c, e := newMockClient(exampleHandlers())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.QueryZoneContext(ctx, "example.", query("example.", dns.TypeSOA)); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if qs := e.Queries(); len(qs) > 0 {
+		t.Errorf("queries sent after cancellation: %v", qs)
+	}
+}
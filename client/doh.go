@@ -0,0 +1,75 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrDoHResponse is returned when a DoH endpoint answers with an HTTP error or
+// with content other than a DNS message.
+var ErrDoHResponse = errors.New("invalid DoH response")
+
+// dohContentType is the media type of DNS messages over HTTPS (RFC 8484).
+const dohContentType = "application/dns-message"
+
+// DoH is an Exchanger sending queries to a DNS over HTTPS (RFC 8484) endpoint
+// with POST requests of the wire message. The address given to ExchangeContext
+// is ignored.
+type DoH struct {
+	// URL is the endpoint, like https://dns.example/dns-query.
+	URL string
+	// Client sends the requests. Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+var _ Exchanger = DoH{}
+
+// ExchangeContext sends m to the endpoint and returns its response.
+func (d DoH) ExchangeContext(ctx context.Context, m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	// The ID is zero to make responses cacheable (RFC 8484 section 4.1).
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	hc := d.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	start := time.Now()
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	ct := resp.Header.Get("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(ct); resp.StatusCode != http.StatusOK || mt != dohContentType {
+		return nil, rtt, fmt.Errorf("%w: HTTP status %q, content type %q", ErrDoHResponse, resp.Status, ct)
+	}
+	r := &dns.Msg{}
+	if err := r.Unpack(body); err != nil {
+		return nil, rtt, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	r.Id = m.Id
+	return r, rtt, nil
+}
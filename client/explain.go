@@ -0,0 +1,86 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NewExplainTracer returns a Tracer narrating each step to w in plain English.
+func NewExplainTracer(w io.Writer) Tracer {
+	et := explainTracer{w: w}
+	return Tracer{
+		GotIntermediaryResponse: et.gotIntermediaryResponse,
+		FollowingCNAME:          et.followingCNAME,
+		Warning:                 et.warning,
+	}
+}
+
+type explainTracer struct {
+	w io.Writer
+}
+
+func (t explainTracer) gotIntermediaryResponse(i int, m *dns.Msg, rs Responses, rtype ResponseType) {
+	w := t.w
+	q := m.Question[0]
+	fr := rs.Fastest()
+	if fr.Msg == nil {
+		fmt.Fprintf(w, "%d. We asked %d server(s) about %s %s but none of them answered.\n", i, len(rs), plain(q.Name), dns.TypeToString[q.Qtype])
+		return
+	}
+	who := "the root server"
+	if fr.Zone != "." {
+		who = "a name server of " + plain(fr.Zone)
+	}
+	fmt.Fprintf(w, "%d. We asked %s, %s (%s), about %s %s. ", i, who, plain(fr.Server.Name), fr.Addr, plain(q.Name), dns.TypeToString[q.Qtype])
+	r := fr.Msg
+	switch rtype {
+	case ResponseTypeDelegation:
+		zone, servers := ParseDelegation(r)
+		names := make([]string, 0, len(servers))
+		for _, s := range servers {
+			names = append(names, plain(s.Name))
+		}
+		if len(names) > 3 {
+			names = append(names[:3], fmt.Sprintf("%d more", len(servers)-3))
+		}
+		fmt.Fprintf(w, "It does not know the answer but told us %s is handled by %s.\n", plain(zone), strings.Join(names, ", "))
+	case ResponseTypeCNAME:
+		var aliases []string
+		for _, rr := range r.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				aliases = append(aliases, fmt.Sprintf("%s is an alias (CNAME) for %s", plain(cname.Hdr.Name), plain(cname.Target)))
+			}
+		}
+		fmt.Fprintf(w, "It told us %s.\n", strings.Join(aliases, " and "))
+	default:
+		switch {
+		case r.Rcode == dns.RcodeNameError:
+			fmt.Fprintf(w, "It told us the name does not exist (NXDOMAIN).\n")
+		case r.Rcode != dns.RcodeSuccess:
+			fmt.Fprintf(w, "It failed to answer (%s).\n", dns.RcodeToString[r.Rcode])
+		case len(r.Answer) == 0:
+			fmt.Fprintf(w, "It told us the name exists but has no %s record.\n", dns.TypeToString[q.Qtype])
+		default:
+			fmt.Fprintf(w, "It gave us the final answer: %d record(s).\n", len(r.Answer))
+		}
+	}
+}
+
+func (t explainTracer) followingCNAME(domain, target string) {
+	fmt.Fprintf(t.w, "   So we start over, looking for %s instead of %s.\n", plain(target), plain(domain))
+}
+
+func (t explainTracer) warning(msg string) {
+	fmt.Fprintf(t.w, "   Note: %s.\n", msg)
+}
+
+// plain returns name without its trailing dot, except for the root.
+func plain(name string) string {
+	if name == "." {
+		return name
+	}
+	return strings.TrimSuffix(name, ".")
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geo is the network origin of an address.
+type Geo struct {
+	ASN     uint32
+	Country string
+}
+
+func (g Geo) String() string {
+	var parts []string
+	if g.ASN != 0 {
+		parts = append(parts, "AS"+strconv.FormatUint(uint64(g.ASN), 10))
+	}
+	if g.Country != "" {
+		parts = append(parts, g.Country)
+	}
+	return strings.Join(parts, " ")
+}
+
+// GeoDB maps networks to their ASN and country.
+type GeoDB struct {
+	nets    map[int]map[string]Geo // prefix length -> network address -> Geo
+	lengths []int                  // prefix lengths, longest first
+}
+
+// LoadGeoDB reads a CSV database of network,asn,country lines, like
+// "192.0.2.0/24,64496,FR". The ASN may have an AS prefix and either field may
+// be empty. Lines starting with # are ignored.
+func LoadGeoDB(r io.Reader) (*GeoDB, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	db := &GeoDB{nets: map[int]map[string]Geo{}}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("line %d: expected network,asn,country", line)
+		}
+		_, n, err := net.ParseCIDR(strings.TrimSpace(rec[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		var g Geo
+		if asn := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rec[1])), "AS"); asn != "" {
+			v, err := strconv.ParseUint(asn, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid ASN %q", line, rec[1])
+			}
+			g.ASN = uint32(v)
+		}
+		g.Country = strings.ToUpper(strings.TrimSpace(rec[2]))
+		ones, _ := n.Mask.Size()
+		if db.nets[ones] == nil {
+			db.nets[ones] = map[string]Geo{}
+			db.lengths = append(db.lengths, ones)
+		}
+		db.nets[ones][n.IP.String()] = g
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(db.lengths)))
+	return db, nil
+}
+
+// Lookup returns the Geo of the most specific network containing addr.
+func (db *GeoDB) Lookup(addr string) (Geo, bool) {
+	ip := net.ParseIP(addr)
+	if db == nil || ip == nil {
+		return Geo{}, false
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	for _, ones := range db.lengths {
+		if ones > bits {
+			continue
+		}
+		key := ip.Mask(net.CIDRMask(ones, bits)).String()
+		if g, found := db.nets[ones][key]; found {
+			return g, true
+		}
+	}
+	return Geo{}, false
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Addresses of the mock servers.
+const (
+	mockRootAddr    = "192.0.2.1"
+	mockExampleAddr = "192.0.2.10"
+)
+
+var errMockTimeout = errors.New("mock: i/o timeout")
+
+// mockHandler answers m, or returns nil to make the exchange fail.
+type mockHandler func(m *dns.Msg) *dns.Msg
+
+type mockQuery struct {
+	Addr     string
+	Question dns.Question
+}
+
+// mockExchanger is an Exchanger answering the queries sent to each address
+// with its handler and recording them.
+type mockExchanger struct {
+	handlers map[string]mockHandler
+
+	mu      sync.Mutex
+	queries []mockQuery
+}
+
+func (e *mockExchanger) ExchangeContext(_ context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	var q dns.Question
+	if len(m.Question) > 0 {
+		q = m.Question[0]
+	}
+	e.mu.Lock()
+	e.queries = append(e.queries, mockQuery{Addr: host, Question: q})
+	h := e.handlers[host]
+	e.mu.Unlock()
+	if h == nil {
+		return nil, 0, errMockTimeout
+	}
+	r := h(m)
+	if r == nil {
+		return nil, 0, errMockTimeout
+	}
+	return r, time.Millisecond, nil
+}
+
+// Queries returns the queries received so far.
+func (e *mockExchanger) Queries() []mockQuery {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]mockQuery(nil), e.queries...)
+}
+
+// newMockClient returns a client sending its queries to handlers, by server
+// address, with a single root server at mockRootAddr.
+func newMockClient(handlers map[string]mockHandler) (*Client, *mockExchanger) {
+	e := &mockExchanger{handlers: handlers}
+	c := New(3)
+	c.Exchanger = e
+	c.SetRoots([]Server{{Name: "a.root.test.", HasGlue: true, Addrs: []string{mockRootAddr}}})
+	return &c, e
+}
+
+// exampleHandlers returns a root delegating example. to ns1.example. at
+// mockExampleAddr, answering www.example. A with 198.51.100.1 and NXDOMAIN
+// for other names.
+func exampleHandlers() map[string]mockHandler {
+	return map[string]mockHandler{
+		mockRootAddr: func(m *dns.Msg) *dns.Msg {
+			return referral(m, "example.", "ns1.example.", mockExampleAddr)
+		},
+		mockExampleAddr: func(m *dns.Msg) *dns.Msg {
+			q := m.Question[0]
+			if q.Name == "www.example." && q.Qtype == dns.TypeA {
+				return reply(m, "www.example. 300 IN A 198.51.100.1")
+			}
+			r := reply(m)
+			r.Rcode = dns.RcodeNameError
+			return r
+		},
+	}
+}
+
+// rr parses s or panics.
+func rr(s string) dns.RR {
+	r, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// reply returns an authoritative response to m with answers.
+func reply(m *dns.Msg, answers ...string) *dns.Msg {
+	r := &dns.Msg{}
+	r.SetReply(m)
+	r.Authoritative = true
+	for _, a := range answers {
+		r.Answer = append(r.Answer, rr(a))
+	}
+	return r
+}
+
+// referral returns a response to m delegating zone to ns, with glue if addr
+// is not empty.
+func referral(m *dns.Msg, zone, ns, addr string) *dns.Msg {
+	r := &dns.Msg{}
+	r.SetReply(m)
+	r.Ns = append(r.Ns, rr(zone+" 3600 IN NS "+ns))
+	if addr != "" {
+		typ := "A"
+		if net.ParseIP(addr).To4() == nil {
+			typ = "AAAA"
+		}
+		r.Extra = append(r.Extra, rr(ns+" 3600 IN "+typ+" "+addr))
+	}
+	return r
+}
+
+// query returns a query for name and qtype.
+func query(name string, qtype uint16) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+func TestRecursiveQueryMock(t *testing.T) {
+	c, e := newMockClient(exampleHandlers())
+	var steps []string
+	tracer := Tracer{GotIntermediaryResponse: func(i int, m *dns.Msg, rs Responses, rtype ResponseType) {
+		steps = append(steps, rs[0].Zone+" "+rtype.String())
+	}}
+	r, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("answer = %v, want www.example. A 198.51.100.1", r.Answer)
+	}
+	if want := []string{". delegation", "example. final"}; !equalStrings(steps, want) {
+		t.Errorf("steps = %v, want %v", steps, want)
+	}
+	qs := e.Queries()
+	if len(qs) != 2 || qs[0].Addr != mockRootAddr || qs[1].Addr != mockExampleAddr {
+		t.Errorf("queries = %v, want the root then ns1.example.", qs)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nilExchanger is an Exchanger returning neither a response nor an error.
+type nilExchanger struct{}
+
+func (nilExchanger) ExchangeContext(context.Context, *dns.Msg, string) (*dns.Msg, time.Duration, error) {
+	return nil, 0, nil
+}
+
+func TestExchangerNilResponse(t *testing.T) {
+	c, _ := newMockClient(nil)
+	c.Exchanger = nilExchanger{}
+	rs := c.ParallelQuery(query("example.", dns.TypeSOA), []Server{{Name: "ns1.example.", Addrs: []string{mockExampleAddr}}})
+	if len(rs) != 1 || !errors.Is(rs[0].Err, ErrNoResponse) {
+		t.Fatalf("responses = %v, want a single ErrNoResponse", rs)
+	}
+	if _, _, err := c.RecursiveQuery(query("www.example.", dns.TypeA), NewTextTracer(io.Discard, TextOptions{})); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("err = %v, want ErrNoResponse", err)
+	}
+}
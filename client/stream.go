@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TraceEventKind is the kind of a TraceEvent.
+type TraceEventKind int
+
+const (
+	// EventStep reports the responses of a step, like
+	// Tracer.GotIntermediaryResponse.
+	EventStep TraceEventKind = iota + 1
+	// EventCNAME reports a CNAME being followed, like Tracer.FollowingCNAME.
+	EventCNAME
+	// EventWarning reports an anomaly, like Tracer.Warning.
+	EventWarning
+)
+
+// TraceEvent is an event of a query streamed by RecursiveQueryStream. The
+// fields set depend on Kind.
+type TraceEvent struct {
+	Kind TraceEventKind
+
+	// EventStep fields.
+	Step      int
+	Query     *dns.Msg
+	Responses Responses
+	Type      ResponseType
+
+	// EventCNAME fields.
+	Domain string
+	Target string
+
+	// EventWarning field.
+	Warning string
+}
+
+// Result is the outcome of a query streamed by RecursiveQueryStream.
+type Result struct {
+	Msg *dns.Msg
+	RTT time.Duration
+	Err error
+}
+
+// RecursiveQueryStream runs RecursiveQueryContext in the background and sends
+// its events to the first channel as they happen. Once the query is done, the
+// events channel is closed, then its Result is sent to the second channel,
+// which is closed too. The events channel must be drained for the query to
+// progress; events not received before ctx is done are dropped.
+func (c *Client) RecursiveQueryStream(ctx context.Context, m *dns.Msg) (<-chan TraceEvent, <-chan Result) {
+	events := make(chan TraceEvent, 16)
+	result := make(chan Result, 1)
+	send := func(e TraceEvent) {
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	}
+	t := Tracer{
+		GotIntermediaryResponse: func(i int, m *dns.Msg, rs Responses, rtype ResponseType) {
+			send(TraceEvent{Kind: EventStep, Step: i, Query: m, Responses: rs, Type: rtype})
+		},
+		FollowingCNAME: func(domain, target string) {
+			send(TraceEvent{Kind: EventCNAME, Domain: domain, Target: target})
+		},
+		Warning: func(msg string) {
+			send(TraceEvent{Kind: EventWarning, Warning: msg})
+		},
+	}
+	go func() {
+		r, rtt, err := c.RecursiveQueryContext(ctx, m, t)
+		close(events)
+		result <- Result{Msg: r, RTT: rtt, Err: err}
+		close(result)
+	}()
+	return events, result
+}
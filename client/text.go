@@ -0,0 +1,375 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Color is an ANSI terminal color code.
+type Color int
+
+// Colors used by the text tracer.
+const (
+	ColorReset    Color = 0
+	ColorBold     Color = 1
+	ColorRed      Color = 31
+	ColorGreen    Color = 32
+	ColorYellow   Color = 33
+	ColorBlue     Color = 34
+	ColorMagenta  Color = 35
+	ColorCyan     Color = 36
+	ColorGray     Color = 37
+	ColorDarkGray Color = 90
+)
+
+// Colorize wraps s with the ANSI escape sequences for color if enabled.
+func Colorize(s interface{}, color Color, enabled bool) string {
+	if !enabled {
+		return fmt.Sprintf("%v", s)
+	}
+	return fmt.Sprintf("\x1b[%dm%v\x1b[0m", color, s)
+}
+
+// Palette maps the colors used by the output to the colors rendered, to adapt
+// them to the terminal background. Colors missing from the palette are
+// rendered as is.
+type Palette map[Color]Color
+
+// Themes are the predefined palettes by name.
+var Themes = map[string]Palette{
+	"dark":  {},
+	"light": {ColorGray: ColorReset, ColorDarkGray: ColorBlue, ColorYellow: ColorMagenta},
+}
+
+// Colorize is like the Colorize function with color remapped by p.
+func (p Palette) Colorize(s interface{}, color Color, enabled bool) string {
+	if pc, found := p[color]; found {
+		color = pc
+	}
+	return Colorize(s, color, enabled)
+}
+
+// TextOptions configures the text tracer.
+type TextOptions struct {
+	// Color enables ANSI colors.
+	Color bool
+	// Palette remaps the colors.
+	Palette Palette
+	// Verbose adds details about each response.
+	Verbose bool
+	// FamilyReport adds the IPv4 and IPv6 RTT of each server to each step.
+	FamilyReport bool
+	// CheckGlue flags in-bailiwick name servers delegated without glue.
+	CheckGlue bool
+	// Percentiles adds the p50, p90 and p99 RTT of the servers to each step.
+	Percentiles bool
+	// Geo, if set, annotates each server address with its ASN and country.
+	Geo *GeoDB
+	// SortServers lists the responses of each step by server name then
+	// address instead of in completion order, for reproducible output.
+	SortServers bool
+}
+
+// NewTextTracer returns a Tracer writing a human readable trace to w.
+func NewTextTracer(w io.Writer, opts TextOptions) Tracer {
+	tt := textTracer{w: w, opts: opts}
+	return Tracer{
+		GotIntermediaryResponse: tt.gotIntermediaryResponse,
+		FollowingCNAME:          tt.followingCNAME,
+		Warning:                 tt.warning,
+	}
+}
+
+type textTracer struct {
+	w    io.Writer
+	opts TextOptions
+}
+
+func (t textTracer) col(s interface{}, c Color) string {
+	return t.opts.Palette.Colorize(s, c, t.opts.Color)
+}
+
+func (t textTracer) gotIntermediaryResponse(i int, m *dns.Msg, rs Responses, rtype ResponseType) {
+	w, col := t.w, t.col
+	if t.opts.SortServers {
+		rs = rs.ByServer()
+	}
+	fr := rs.Fastest()
+	var r *dns.Msg
+	if fr != nil {
+		r = fr.Msg
+	}
+	qname := m.Question[0].Name
+	qtype := dns.TypeToString[m.Question[0].Qtype]
+	if i > 1 {
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d - query %s %s", i, qtype, qname)
+	if len(rs) > 0 {
+		fmt.Fprintf(w, " (step took %.2fms)", float64(rs.Elapsed())/float64(time.Millisecond))
+	}
+	if r != nil {
+		fmt.Fprintf(w, " via %s", col(fmt.Sprintf("%s(%s)", fr.Server.Name, fr.Addr), ColorBold))
+		fmt.Fprintf(w, ": %s", strings.Replace(strings.Replace(r.MsgHdr.String(), ";; ", "", -1), "\n", ", ", -1))
+	}
+	fmt.Fprintln(w)
+	labels := hashLabels(rs)
+	for _, pr := range rs {
+		ln := 0
+		if pr.Msg != nil {
+			ln = pr.Msg.Len()
+		}
+		rtt := float64(pr.RTT) / float64(time.Millisecond)
+		lrtt := "0ms (from cache)"
+		if pr.Server.HasGlue {
+			lrtt = "0ms (from glue)"
+		} else if pr.Server.Hinted {
+			lrtt = "0ms (from hints)"
+		} else if pr.Server.LookupRTT > 0 {
+			lrtt = fmt.Sprintf("%.2fms", float64(pr.Server.LookupRTT)/float64(time.Millisecond))
+		}
+		if pr.Cached {
+			fmt.Fprintf(w, col("  - %d bytes from the answer cache for %s(%s)", ColorDarkGray), ln, pr.Server.Name, pr.Addr)
+		} else {
+			fmt.Fprintf(w, col("  - %d bytes in %.2fms + %s lookup on %s(%s)", ColorDarkGray), ln, rtt, lrtt, pr.Server.Name, pr.Addr)
+		}
+		if g, found := t.opts.Geo.Lookup(pr.Addr); found && g != (Geo{}) {
+			fmt.Fprintf(w, " %s", col("["+g.String()+"]", ColorCyan))
+		}
+		if pr.Fallbacks > 0 {
+			fmt.Fprintf(w, col(" over %s", ColorDarkGray), pr.Transport)
+		}
+		if pr.Err != nil {
+			err := pr.Err
+			if oerr, ok := err.(*net.OpError); ok {
+				err = oerr.Err
+			}
+			fmt.Fprintf(w, ": %v", col(err, errorColor(pr.Err)))
+		} else if l := labels[ResponseHash(pr.Msg)]; l != "" && (len(labels) > 1 || t.opts.Verbose) {
+			fmt.Fprintf(w, " %s", col("["+l+"]", ColorMagenta))
+			if t.opts.Verbose {
+				fmt.Fprintf(w, col(" %s", ColorDarkGray), ResponseHash(pr.Msg))
+			}
+		}
+		if issue := EDNSIssue(m, pr.Msg); issue != "" {
+			fmt.Fprintf(w, " %s", col("("+issue+")", ColorYellow))
+		}
+		fmt.Fprint(w, "\n")
+		if t.opts.Verbose {
+			t.ednsOptions(pr.Msg)
+			if pr.Keepalive > 0 {
+				fmt.Fprintln(w, col(fmt.Sprintf("    tcp keepalive: %v", pr.Keepalive), ColorDarkGray))
+			}
+		}
+	}
+	if t.opts.Verbose {
+		t.selection(rs)
+	}
+	if t.opts.FamilyReport {
+		t.familyReport(rs)
+	}
+	if t.opts.Percentiles {
+		t.percentiles(rs)
+	}
+	if r != nil {
+		t.additional(r)
+	}
+
+	switch rtype {
+	case ResponseTypeDelegation:
+		label, ns := ParseDelegation(r)
+		var missingGlue []string
+		for _, s := range ns {
+			var glue string
+			if s.HasGlue {
+				glue = col("glue: "+strings.Join(s.Addrs, ","), ColorDarkGray)
+			} else if s.Hinted {
+				glue = col("svcb hints: "+strings.Join(s.Addrs, ","), ColorDarkGray)
+			} else if t.opts.CheckGlue && s.NeedsGlue(label) {
+				glue = col("no glue, required", ColorRed)
+				missingGlue = append(missingGlue, s.Name)
+			} else {
+				glue = col("no glue", ColorYellow)
+			}
+			fmt.Fprintf(w, "%s %d NS %s (%s)\n", label, s.TTL, s.Name, glue)
+		}
+		for _, name := range missingGlue {
+			fmt.Fprintln(w, col(fmt.Sprintf("! %s: in-bailiwick NS %s has no glue, delegation is potentially unresolvable", label, name), ColorRed))
+		}
+	case ResponseTypeCNAME:
+		for _, rr := range r.Answer {
+			fmt.Fprintln(w, rr)
+		}
+	}
+}
+
+// hashLabels maps the ResponseHash of each successful response of rs to a
+// short label, A for the first distinct content, B for the next and so on.
+func hashLabels(rs Responses) map[string]string {
+	labels := map[string]string{}
+	for _, r := range rs {
+		if r.Err != nil || r.Msg == nil {
+			continue
+		}
+		h := ResponseHash(r.Msg)
+		if _, found := labels[h]; !found {
+			labels[h] = string(rune('A' + len(labels)%26))
+		}
+	}
+	return labels
+}
+
+// errorColor returns the color of err depending on its category: yellow for
+// timeouts, magenta for malformed or rejected responses and red for other
+// network errors.
+func errorColor(err error) Color {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return ColorYellow
+	case errors.Is(err, ErrMalformed), errors.Is(err, ErrIDMismatch), errors.Is(err, ErrQuestionMismatch),
+		errors.Is(err, ErrResponseTooLarge):
+		return ColorMagenta
+	default:
+		return ColorRed
+	}
+}
+
+// additional prints the number of records of each type found in the
+// additional section of r, always in verbose mode and otherwise only if it
+// holds more than address glue.
+func (t textTracer) additional(r *dns.Msg) {
+	var types []string
+	counts := map[string]int{}
+	other := false
+	for _, rr := range r.Extra {
+		rrtype := rr.Header().Rrtype
+		switch rrtype {
+		case dns.TypeOPT:
+			continue
+		case dns.TypeA, dns.TypeAAAA:
+		default:
+			other = true
+		}
+		name := dns.TypeToString[rrtype]
+		if counts[name] == 0 {
+			types = append(types, name)
+		}
+		counts[name]++
+	}
+	if len(types) == 0 || !(other || t.opts.Verbose) {
+		return
+	}
+	parts := make([]string, 0, len(types))
+	for _, name := range types {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[name], name))
+	}
+	fmt.Fprintln(t.w, t.col("  additional: "+strings.Join(parts, ", "), ColorDarkGray))
+}
+
+// selection prints why the fastest response of rs was selected and its
+// margin over the runner-up.
+func (t textTracer) selection(rs Responses) {
+	ranked := rs.Ranked()
+	if len(ranked) == 0 {
+		return
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	w := ranked[0]
+	msg := fmt.Sprintf("  selected %s(%s): lowest RTT + lookup time (%.2fms)", w.Server.Name, w.Addr, ms(w.RTT+w.Server.LookupRTT))
+	if len(ranked) > 1 {
+		ru := ranked[1]
+		msg += fmt.Sprintf(", %.2fms ahead of %s(%s)", ms(ru.RTT+ru.Server.LookupRTT-w.RTT-w.Server.LookupRTT), ru.Server.Name, ru.Addr)
+	}
+	fmt.Fprintln(t.w, t.col(msg, ColorDarkGray))
+}
+
+// percentiles prints the RTT percentiles of the successful responses of rs.
+func (t textTracer) percentiles(rs Responses) {
+	n := len(rs.Ranked())
+	if n == 0 {
+		return
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	fmt.Fprintln(t.w, t.col(fmt.Sprintf("  rtt over %d responses: p50 %.2fms, p90 %.2fms, p99 %.2fms", n,
+		ms(rs.Percentile(50)), ms(rs.Percentile(90)), ms(rs.Percentile(99))), ColorDarkGray))
+}
+
+// ednsOptions prints the EDNS0 local options found in r.
+func (t textTracer) ednsOptions(r *dns.Msg) {
+	if r == nil {
+		return
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok {
+			fmt.Fprintln(t.w, t.col(fmt.Sprintf("    edns option %d: %x", l.Code, l.Data), ColorDarkGray))
+		}
+	}
+}
+
+func (t textTracer) followingCNAME(domain, target string) {
+	fmt.Fprintf(t.w, t.col("\n~ following CNAME %s -> %s\n", ColorBlue), domain, target)
+}
+
+func (t textTracer) warning(msg string) {
+	fmt.Fprintln(t.w, t.col("! "+msg, ColorYellow))
+}
+
+// familyReport prints the best IPv4 and IPv6 RTT of each server in rs and
+// flags servers only reachable over one of the two families.
+func (t textTracer) familyReport(rs Responses) {
+	type familyStat struct {
+		tried, ok bool
+		rtt       time.Duration
+	}
+	var names []string
+	stats := map[string]*[2]familyStat{}
+	for _, r := range rs {
+		st := stats[r.Server.Name]
+		if st == nil {
+			st = &[2]familyStat{}
+			stats[r.Server.Name] = st
+			names = append(names, r.Server.Name)
+		}
+		f := &st[0]
+		if r.Family == 6 {
+			f = &st[1]
+		}
+		f.tried = true
+		if r.Err == nil && (!f.ok || r.RTT < f.rtt) {
+			f.ok, f.rtt = true, r.RTT
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st := stats[name]
+		res := [2]string{}
+		for i, f := range st {
+			switch {
+			case !f.tried:
+				res[i] = "no address"
+			case !f.ok:
+				res[i] = t.col("unreachable", ColorRed)
+			default:
+				res[i] = fmt.Sprintf("%.2fms", float64(f.rtt)/float64(time.Millisecond))
+			}
+		}
+		fmt.Fprintf(t.w, t.col("  * %s IPv4: %s, IPv6: %s", ColorDarkGray), name, res[0], res[1])
+		if st[0].tried && st[1].tried && st[0].ok != st[1].ok {
+			fmt.Fprint(t.w, t.col(" (reachable on one family only)", ColorYellow))
+		}
+		fmt.Fprint(t.w, "\n")
+	}
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Trace is a structured record of a recursive query.
+type Trace struct {
+	Question dns.Question
+	Start    time.Time
+	Steps    []TraceStep
+	CNAMEs   [][2]string
+	Warnings []string
+	Answer   *dns.Msg
+	RTT      time.Duration
+	Err      error
+
+	// Chain is the queried name followed by each CNAME target up to the final
+	// name, including the hops answered within a single response. It is set
+	// by Finish and holds the queried name only when no CNAME was met.
+	Chain []string
+
+	// TimeLocation is the time zone of the timestamps written by WriteJSON.
+	// Nil means UTC.
+	TimeLocation *time.Location
+	// TimeLayout is the format of the timestamps written by WriteJSON. Empty
+	// means time.RFC3339Nano.
+	TimeLayout string
+}
+
+// RFC3339Milli is a RFC 3339 time layout with millisecond precision.
+const RFC3339Milli = "2006-01-02T15:04:05.000Z07:00"
+
+// TraceStep is a step of a Trace.
+type TraceStep struct {
+	Index     int
+	Question  dns.Question
+	Zone      string
+	Type      ResponseType
+	Responses Responses
+}
+
+// NewTrace creates a Trace for q, started now.
+func NewTrace(q dns.Question) *Trace {
+	return &Trace{Question: q, Start: time.Now()}
+}
+
+// Tracer returns a Tracer recording the query events into t.
+func (t *Trace) Tracer() Tracer {
+	return Tracer{
+		GotIntermediaryResponse: func(i int, m *dns.Msg, rs Responses, rtype ResponseType) {
+			s := TraceStep{
+				Index:     i,
+				Question:  m.Question[0],
+				Type:      rtype,
+				Responses: rs,
+			}
+			if len(rs) > 0 {
+				s.Zone = rs[0].Zone
+			}
+			t.Steps = append(t.Steps, s)
+		},
+		FollowingCNAME: func(domain, target string) {
+			t.CNAMEs = append(t.CNAMEs, [2]string{domain, target})
+		},
+		Warning: func(msg string) {
+			t.Warnings = append(t.Warnings, msg)
+		},
+	}
+}
+
+// TraceQuery performs a recursive query like RecursiveQueryContext and returns
+// its finished Trace, keeping the responses of every step for inspection once
+// the query is done. When DropOversized is set, the messages of the responses
+// exceeding MaxResponseSize are not kept.
+func (c *Client) TraceQuery(ctx context.Context, m *dns.Msg) *Trace {
+	if len(m.Question) != 1 {
+		t := NewTrace(dns.Question{})
+		t.Err = fmt.Errorf("%w, got %d", ErrQuestionCount, len(m.Question))
+		return t
+	}
+	t := NewTrace(m.Question[0])
+	r, rtt, err := c.RecursiveQueryContext(ctx, m, t.Tracer())
+	if c.DropOversized {
+		for _, s := range t.Steps {
+			for i := range s.Responses {
+				if errors.Is(s.Responses[i].Err, ErrResponseTooLarge) {
+					s.Responses[i].Msg = nil
+				}
+			}
+		}
+	}
+	t.Finish(r, rtt, err)
+	return t
+}
+
+// Step returns the first step answered by the name servers of zone, or nil if
+// none was.
+func (t *Trace) Step(zone string) *TraceStep {
+	for i := range t.Steps {
+		if domainEqual(t.Steps[i].Zone, zone) {
+			return &t.Steps[i]
+		}
+	}
+	return nil
+}
+
+// Finish records the result of the query.
+func (t *Trace) Finish(r *dns.Msg, rtt time.Duration, err error) {
+	t.Answer, t.RTT, t.Err = r, rtt, err
+	t.Chain = t.chain()
+}
+
+// chain follows the CNAME records of the answers received from the queried
+// name.
+func (t *Trace) chain() []string {
+	var cnames []*dns.CNAME
+	add := func(m *dns.Msg) {
+		for _, rr := range m.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				cnames = append(cnames, cname)
+			}
+		}
+	}
+	for _, s := range t.Steps {
+		if fr := s.Responses.Fastest(); fr.Msg != nil {
+			add(fr.Msg)
+		}
+	}
+	if t.Answer != nil {
+		add(t.Answer)
+	}
+	chain := []string{t.Question.Name}
+	if t.Question.Qtype == dns.TypeCNAME {
+		return chain
+	}
+	for range cnames { // bounds CNAME loops
+		name := chain[len(chain)-1]
+		found := false
+		for _, cname := range cnames {
+			if domainEqual(cname.Hdr.Name, name) {
+				chain, found = append(chain, cname.Target), true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return chain
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type jsonResponse struct {
+	Server    string  `json:"server"`
+	Addr      string  `json:"addr"`
+	Family    int     `json:"family"`
+	Glue      bool    `json:"glue"`
+	LookupRTT float64 `json:"lookup_rtt_ms"`
+	Start     string  `json:"start"`
+	RTT       float64 `json:"rtt_ms"`
+	Transport string  `json:"transport,omitempty"`
+	LocalPort int     `json:"local_port,omitempty"`
+	Cached    bool    `json:"cached,omitempty"`
+	Bytes     int     `json:"bytes,omitempty"`
+	Rcode     string  `json:"rcode,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type jsonStep struct {
+	Step      int            `json:"step"`
+	Query     jsonQuestion   `json:"query"`
+	Zone      string         `json:"zone"`
+	Type      string         `json:"type"`
+	Fastest   string         `json:"fastest,omitempty"`
+	Elapsed   float64        `json:"elapsed_ms"`
+	RunnerUp  string         `json:"runner_up,omitempty"`
+	Margin    float64        `json:"margin_ms,omitempty"`
+	Responses []jsonResponse `json:"responses"`
+}
+
+type jsonTrace struct {
+	Question jsonQuestion `json:"question"`
+	Start    string       `json:"start"`
+	Steps    []jsonStep   `json:"steps"`
+	CNAMEs   [][2]string  `json:"cnames,omitempty"`
+	Chain    []string     `json:"chain,omitempty"`
+	Warnings []string     `json:"warnings,omitempty"`
+	RTT      float64      `json:"rtt_ms"`
+	Rcode    string       `json:"rcode,omitempty"`
+	Answer   []string     `json:"answer,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+func jsonMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (t *Trace) jsonTime(ts time.Time) string {
+	loc, layout := t.TimeLocation, t.TimeLayout
+	if loc == nil {
+		loc = time.UTC
+	}
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+	return ts.In(loc).Format(layout)
+}
+
+func newJSONQuestion(q dns.Question) jsonQuestion {
+	return jsonQuestion{Name: q.Name, Type: dns.TypeToString[q.Qtype]}
+}
+
+// WriteJSON writes t to w as JSON.
+func (t *Trace) WriteJSON(w io.Writer) error {
+	jt := jsonTrace{
+		Question: newJSONQuestion(t.Question),
+		Start:    t.jsonTime(t.Start),
+		Steps:    make([]jsonStep, 0, len(t.Steps)),
+		CNAMEs:   t.CNAMEs,
+		Warnings: t.Warnings,
+		RTT:      jsonMs(t.RTT),
+	}
+	if len(t.Chain) > 1 {
+		jt.Chain = t.Chain
+	}
+	for _, s := range t.Steps {
+		js := jsonStep{
+			Step:      s.Index,
+			Query:     newJSONQuestion(s.Question),
+			Zone:      s.Zone,
+			Type:      s.Type.String(),
+			Elapsed:   jsonMs(s.Responses.Elapsed()),
+			Responses: make([]jsonResponse, 0, len(s.Responses)),
+		}
+		if ranked := s.Responses.Ranked(); len(ranked) > 0 {
+			js.Fastest = ranked[0].Addr
+			if len(ranked) > 1 {
+				js.RunnerUp = ranked[1].Addr
+				js.Margin = jsonMs(ranked[1].RTT + ranked[1].Server.LookupRTT - ranked[0].RTT - ranked[0].Server.LookupRTT)
+			}
+		}
+		for _, r := range s.Responses {
+			jr := jsonResponse{
+				Server:    r.Server.Name,
+				Addr:      r.Addr,
+				Family:    r.Family,
+				Glue:      r.Server.HasGlue,
+				LookupRTT: jsonMs(r.Server.LookupRTT),
+				Start:     t.jsonTime(r.Start),
+				RTT:       jsonMs(r.RTT),
+				Transport: r.Transport,
+				LocalPort: r.LocalPort,
+				Cached:    r.Cached,
+			}
+			if r.Msg != nil {
+				jr.Bytes = r.Msg.Len()
+				jr.Rcode = dns.RcodeToString[r.Msg.Rcode]
+			}
+			if r.Err != nil {
+				jr.Error = r.Err.Error()
+			}
+			js.Responses = append(js.Responses, jr)
+		}
+		jt.Steps = append(jt.Steps, js)
+	}
+	if t.Answer != nil {
+		jt.Rcode = dns.RcodeToString[t.Answer.Rcode]
+		for _, rr := range t.Answer.Answer {
+			jt.Answer = append(jt.Answer, rr.String())
+		}
+	}
+	if t.Err != nil {
+		jt.Error = t.Err.Error()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jt)
+}
@@ -0,0 +1,20 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTraceQueryNoQuestion(t *testing.T) {
+	c, e := newMockClient(exampleHandlers())
+	tr := c.TraceQuery(context.Background(), &dns.Msg{})
+	if !errors.Is(tr.Err, ErrQuestionCount) {
+		t.Errorf("err = %v, want ErrQuestionCount", tr.Err)
+	}
+	if qs := e.Queries(); len(qs) > 0 {
+		t.Errorf("queries sent: %v", qs)
+	}
+}
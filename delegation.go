@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/dnstrace/client"
+)
+
+// delegation walks the delegations down to the zone qname belongs to and
+// prints its name servers and the SOA record served by each of them, without
+// querying qname itself.
+func delegation(ctx context.Context, c *client.Client, qname string, o options) error {
+	col := o.col
+	start := time.Now()
+	zone, servers, err := c.Delegation(ctx, qname)
+	if err != nil {
+		return err
+	}
+	if zone == "" {
+		zone = "."
+	}
+	fmt.Printf(col(";; %s is served by %d name server(s), found in %s\n\n", client.ColorGray), zone, len(servers), time.Since(start))
+	for _, s := range servers {
+		fmt.Printf("%s\t%d\tIN\tNS\t%s", zone, s.TTL, s.Name)
+		switch {
+		case len(s.Addrs) > 0:
+			fmt.Printf(col("\t; %s", client.ColorDarkGray), strings.Join(s.Addrs, ", "))
+		case s.LookupErr != nil:
+			fmt.Printf(col("\t; %v", client.ColorRed), s.LookupErr)
+		}
+		fmt.Println()
+	}
+
+	rs := c.ParallelQueryContext(ctx, newQuery(zone, dns.TypeSOA, o), servers)
+	if fr := rs.Fastest(); fr.Msg != nil {
+		for _, rr := range fr.Msg.Answer {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				fmt.Println(rr)
+			}
+		}
+	}
+	serials := map[uint32]bool{}
+	lines := make([]string, 0, len(rs))
+	for _, r := range rs.ByServer() {
+		line := fmt.Sprintf("%s(%s): ", r.Server.Name, r.Addr)
+		switch soa := soaOf(r.Msg, zone); {
+		case r.Err != nil:
+			line += col(fmt.Sprint(r.Err), client.ColorRed)
+		case soa == nil:
+			line += col(fmt.Sprintf("no SOA (%s)", dns.RcodeToString[r.Msg.Rcode]), client.ColorRed)
+		default:
+			serials[soa.Serial] = true
+			line += fmt.Sprintf("serial %d", soa.Serial)
+			if !r.Msg.Authoritative {
+				line += col(" (not authoritative)", client.ColorYellow)
+			}
+		}
+		lines = append(lines, line)
+	}
+	if len(serials) > 1 {
+		fmt.Println(col("\n! SOA serials differ between the name servers:", client.ColorYellow))
+	} else {
+		fmt.Println()
+	}
+	for _, line := range lines {
+		fmt.Printf(";;   %s\n", line)
+	}
+	return ctx.Err()
+}
+
+// soaOf returns the SOA record of zone in the answer of r, or nil.
+func soaOf(r *dns.Msg, zone string) *dns.SOA {
+	if r == nil {
+		return nil
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			return soa
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// errUnexpected is returned when the answer does not match the -expect and
+// -expect-rcode flags.
+var errUnexpected = errors.New("answer does not match expectations")
+
+// listFlag is a repeatable flag also accepting comma separated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// checkExpect verifies that r has the expected rcode (if not empty) and that
+// its answer contains all the expected values. A diff is written to w on
+// mismatch.
+func checkExpect(w io.Writer, r *dns.Msg, expect []string, rcode string) bool {
+	ok := true
+	var diff []string
+	if rcode != "" && !strings.EqualFold(rcode, dns.RcodeToString[r.Rcode]) {
+		ok = false
+		diff = append(diff, fmt.Sprintf("- rcode %s", strings.ToUpper(rcode)), fmt.Sprintf("+ rcode %s", dns.RcodeToString[r.Rcode]))
+	}
+	var values []string
+	for _, rr := range r.Answer {
+		values = append(values, rdata(rr))
+	}
+	for _, e := range expect {
+		found := false
+		for _, v := range values {
+			if valueEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ok = false
+			diff = append(diff, "- "+e)
+		}
+	}
+	if ok {
+		return true
+	}
+	fmt.Fprintln(w, "\n;; Expectation failed (- expected, + got):")
+	for _, d := range diff {
+		fmt.Fprintln(w, ";;   "+d)
+	}
+	for _, v := range values {
+		fmt.Fprintln(w, ";;   + "+v)
+	}
+	return false
+}
+
+// valueEqual returns true if the expected value e matches the rdata v,
+// ignoring case, TXT quotes, trailing dots and IP address notation.
+func valueEqual(e, v string) bool {
+	if ip := net.ParseIP(e); ip != nil {
+		return ip.Equal(net.ParseIP(v))
+	}
+	v = strings.Trim(v, `"`)
+	return strings.EqualFold(e, v) || strings.EqualFold(dns.Fqdn(e), v)
+}
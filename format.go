@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Answer output formats.
+const (
+	formatLong  = "long"
+	formatShort = "short"
+	formatDig   = "dig"
+	formatZone  = "zone"
+)
+
+// writeAnswer writes the final answer r using the given format.
+func writeAnswer(w io.Writer, r *dns.Msg, rtt time.Duration, format string, verbose bool) {
+	switch format {
+	case formatShort:
+		for _, rr := range r.Answer {
+			fmt.Fprintln(w, rdata(rr))
+		}
+	case formatDig:
+		fmt.Fprintln(w, r)
+		fmt.Fprintf(w, ";; Query time: %d msec\n", rtt/time.Millisecond)
+	default:
+		for _, rr := range r.Answer {
+			fmt.Fprintln(w, formatRR(rr, verbose))
+		}
+	}
+}
+
+// finalAnswer returns the records of answer matching the type of q at the end
+// of the CNAME chain starting at the name of q.
+func finalAnswer(answer []dns.RR, q dns.Question) []dns.RR {
+	name := q.Name
+	if q.Qtype != dns.TypeCNAME {
+		for i := 0; i < len(answer); i++ { // bounds CNAME loops
+			found := false
+			for _, rr := range answer {
+				if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+					name, found = cname.Target, true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+	}
+	var rrs []dns.RR
+	for _, rr := range answer {
+		h := rr.Header()
+		if strings.EqualFold(h.Name, name) && (h.Rrtype == q.Qtype || q.Qtype == dns.TypeANY) {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// sortAnswer returns a copy of answer with the records of each owner name
+// sorted by type, then by wire format rdata (RFC 4034 section 6.3). Owner names
+// keep their order of appearance so CNAME chains still read in order.
+func sortAnswer(answer []dns.RR) []dns.RR {
+	owners := map[string]int{}
+	keys := make(map[dns.RR]string, len(answer))
+	for _, rr := range answer {
+		name := strings.ToLower(rr.Header().Name)
+		if _, found := owners[name]; !found {
+			owners[name] = len(owners)
+		}
+		keys[rr] = wireRdata(rr)
+	}
+	sorted := append([]dns.RR(nil), answer...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Header(), sorted[j].Header()
+		if oa, ob := owners[strings.ToLower(a.Name)], owners[strings.ToLower(b.Name)]; oa != ob {
+			return oa < ob
+		}
+		if a.Rrtype != b.Rrtype {
+			return a.Rrtype < b.Rrtype
+		}
+		return keys[sorted[i]] < keys[sorted[j]]
+	})
+	return sorted
+}
+
+// wireRdata returns the uncompressed wire format rdata of rr.
+func wireRdata(rr dns.RR) string {
+	rr = dns.Copy(rr) // PackRR sets Rdlength
+	buf := make([]byte, dns.Len(rr))
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return rr.String()
+	}
+	return string(buf[off-int(rr.Header().Rdlength) : off])
+}
+
+// rdata returns the presentation format of rr without its header, like dig
+// +short.
+func rdata(rr dns.RR) string {
+	if txt, ok := rr.(*dns.TXT); ok {
+		rr = &dns.TXT{Hdr: txt.Hdr, Txt: []string{strings.Join(txt.Txt, "")}}
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// formatRR returns the presentation format of rr. TXT records split in
+// multiple character strings are reassembled, with the raw chunked form kept
+// in verbose mode.
+func formatRR(rr dns.RR, verbose bool) string {
+	if txt, ok := rr.(*dns.TXT); ok && len(txt.Txt) > 1 {
+		joined := &dns.TXT{Hdr: txt.Hdr, Txt: []string{strings.Join(txt.Txt, "")}}
+		if verbose {
+			return txt.String() + "\n; reassembled: " + joined.String()
+		}
+		return joined.String()
+	}
+	return rr.String()
+}
+
+// writeMX writes the MX records of answer sorted by preference. If lookup is
+// not nil, it is used to resolve the addresses of each exchange.
+func writeMX(w io.Writer, answer []dns.RR, lookup func(host string) []string) {
+	var mxs []*dns.MX
+	for _, rr := range answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			mxs = append(mxs, mx)
+		}
+	}
+	if len(mxs) == 0 {
+		return
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Preference < mxs[j].Preference
+	})
+	fmt.Fprintln(w, "\n;; Mail exchangers by preference:")
+	for _, mx := range mxs {
+		fmt.Fprintf(w, ";;   %d %s", mx.Preference, mx.Mx)
+		if lookup != nil {
+			if addrs := lookup(mx.Mx); len(addrs) > 0 {
+				fmt.Fprintf(w, " (%s)", strings.Join(addrs, ", "))
+			} else {
+				fmt.Fprint(w, " (unresolved)")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeSRV writes the SRV records of answer sorted by priority then by
+// decreasing weight. If lookup is not nil, it is used to resolve the addresses
+// of each target, listed as endpoints with the record port.
+func writeSRV(w io.Writer, answer []dns.RR, lookup func(host string) []string) {
+	var srvs []*dns.SRV
+	for _, rr := range answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, srv)
+		}
+	}
+	if len(srvs) == 0 {
+		return
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	fmt.Fprintln(w, "\n;; Service endpoints by priority and weight:")
+	for _, srv := range srvs {
+		port := strconv.Itoa(int(srv.Port))
+		if srv.Target == "." {
+			fmt.Fprintf(w, ";;   %d %d . (service not available)\n", srv.Priority, srv.Weight)
+			continue
+		}
+		fmt.Fprintf(w, ";;   %d %d %s", srv.Priority, srv.Weight, net.JoinHostPort(srv.Target, port))
+		if lookup != nil {
+			if addrs := lookup(srv.Target); len(addrs) > 0 {
+				eps := make([]string, 0, len(addrs))
+				for _, addr := range addrs {
+					eps = append(eps, net.JoinHostPort(addr, port))
+				}
+				fmt.Fprintf(w, " (%s)", strings.Join(eps, ", "))
+			} else {
+				fmt.Fprint(w, " (unresolved)")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeNAPTR writes the NAPTR records of answer sorted by order then
+// preference in aligned columns. If lookup and lookupSRV are not nil, the
+// replacement of the rules with the S flag is resolved as SRV endpoints and the
+// one of the rules with the A flag as addresses.
+func writeNAPTR(w io.Writer, answer []dns.RR, lookup, lookupSRV func(name string) []string) {
+	var naptrs []*dns.NAPTR
+	for _, rr := range answer {
+		if naptr, ok := rr.(*dns.NAPTR); ok {
+			naptrs = append(naptrs, naptr)
+		}
+	}
+	if len(naptrs) == 0 {
+		return
+	}
+	sort.SliceStable(naptrs, func(i, j int) bool {
+		if naptrs[i].Order != naptrs[j].Order {
+			return naptrs[i].Order < naptrs[j].Order
+		}
+		return naptrs[i].Preference < naptrs[j].Preference
+	})
+	fmt.Fprintln(w, "\n;; NAPTR rules by order and preference:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, ";;   order\tpref\tflags\tservice\tregexp\treplacement")
+	for _, naptr := range naptrs {
+		fmt.Fprintf(tw, ";;   %d\t%d\t%s\t%s\t%s\t%s\n", naptr.Order, naptr.Preference,
+			orDash(naptr.Flags), orDash(naptr.Service), orDash(naptr.Regexp), naptr.Replacement)
+	}
+	tw.Flush()
+	if lookup == nil || lookupSRV == nil {
+		return
+	}
+	for _, naptr := range naptrs {
+		if naptr.Replacement == "." {
+			continue
+		}
+		var kind string
+		var targets []string
+		switch strings.ToUpper(naptr.Flags) {
+		case "S":
+			kind, targets = "SRV", lookupSRV(naptr.Replacement)
+		case "A":
+			kind, targets = "addresses", lookup(naptr.Replacement)
+		default:
+			continue
+		}
+		if len(targets) == 0 {
+			fmt.Fprintf(w, ";;   %s %s: unresolved\n", naptr.Replacement, kind)
+			continue
+		}
+		fmt.Fprintf(w, ";;   %s %s: %s\n", naptr.Replacement, kind, strings.Join(targets, ", "))
+	}
+}
+
+// orDash returns s or "-" if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// writeFamilies writes the IPv4 and IPv6 addresses found in the answers of
+// rs labeled with their family.
+func writeFamilies(w io.Writer, rs ...*dns.Msg) {
+	var v4, v6 []string
+	for _, r := range rs {
+		if r == nil {
+			continue
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				v4 = append(v4, rr.A.String())
+			case *dns.AAAA:
+				v6 = append(v6, rr.AAAA.String())
+			}
+		}
+	}
+	fmt.Fprintln(w, "\n;; Addresses by family:")
+	for _, f := range []struct {
+		name  string
+		addrs []string
+	}{{"IPv4", v4}, {"IPv6", v6}} {
+		if len(f.addrs) == 0 {
+			fmt.Fprintf(w, ";;   %s none\n", f.name)
+			continue
+		}
+		for _, addr := range f.addrs {
+			fmt.Fprintf(w, ";;   %s %s\n", f.name, addr)
+		}
+	}
+}
+
+// writeCAA writes the CAA records of answer as a table of tags and values
+// followed by a summary of which CAs may issue certificates.
+func writeCAA(w io.Writer, answer []dns.RR) {
+	var caas []*dns.CAA
+	for _, rr := range answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			caas = append(caas, caa)
+		}
+	}
+	if len(caas) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\n;; Certificate authority authorization:")
+	issuers := map[string][]string{}
+	seen := map[string]bool{}
+	for _, caa := range caas {
+		var critical string
+		if caa.Flag&128 != 0 {
+			critical = " (critical)"
+		}
+		fmt.Fprintf(w, ";;   %-10s %s%s\n", caa.Tag, caa.Value, critical)
+		tag := strings.ToLower(caa.Tag)
+		if tag == "issue" || tag == "issuewild" {
+			seen[tag] = true
+			// Parameters such as account URIs follow the issuer domain.
+			if issuer := strings.TrimSpace(strings.SplitN(caa.Value, ";", 2)[0]); issuer != "" {
+				issuers[tag] = append(issuers[tag], issuer)
+			}
+		}
+	}
+	switch {
+	case !seen["issue"]:
+		fmt.Fprintln(w, ";; issuance: not restricted, any CA may issue")
+	case len(issuers["issue"]) == 0:
+		fmt.Fprintln(w, ";; issuance: forbidden")
+	default:
+		fmt.Fprintf(w, ";; issuance: restricted to %s\n", strings.Join(issuers["issue"], ", "))
+	}
+	switch {
+	case !seen["issuewild"]:
+	case len(issuers["issuewild"]) == 0:
+		fmt.Fprintln(w, ";; wildcard issuance: forbidden")
+	default:
+		fmt.Fprintf(w, ";; wildcard issuance: restricted to %s\n", strings.Join(issuers["issuewild"], ", "))
+	}
+}
+
+// writeZone writes rrs as a BIND zone file fragment with aligned columns.
+func writeZone(w io.Writer, q dns.Question, rrs []dns.RR) {
+	fmt.Fprintf(w, "; dnstrace %s %s\n", dns.TypeToString[q.Qtype], q.Name)
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	for _, rr := range rrs {
+		h := rr.Header()
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", h.Name, h.Ttl, dns.ClassToString[h.Class], dns.TypeToString[h.Rrtype],
+			strings.TrimPrefix(rr.String(), h.String()))
+	}
+	tw.Flush()
+}
@@ -1,5 +1,10 @@
 module github.com/rs/dnstrace
 
-go 1.16
+go 1.21
 
-require github.com/miekg/dns v1.1.50
\ No newline at end of file
+require github.com/miekg/dns v1.1.50
+
+require (
+	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rs/dnstrace/client"
+)
+
+// errUnhealthy is returned when the -health verdict is FAIL.
+var errUnhealthy = errors.New("zone is unhealthy")
+
+// Health verdicts, from best to worst.
+const (
+	healthPass = iota
+	healthWarn
+	healthFail
+)
+
+var healthVerdicts = [...]string{"PASS", "WARN", "FAIL"}
+
+type healthIssue struct {
+	level int
+	msg   string
+}
+
+// checkHealth runs the delegation, glue, stale glue, lame server, NS consistency and
+// redundancy checks of zone reached by tr and returns the issues found. The
+// network prefix summary is always included, as a PASS issue.
+func checkHealth(c *client.Client, tr *client.Trace, zone string) []healthIssue {
+	var issues []healthIssue
+	add := func(level int, format string, a ...interface{}) {
+		issues = append(issues, healthIssue{level, fmt.Sprintf(format, a...)})
+	}
+	if tr.Err != nil {
+		add(healthFail, "trace failed: %v", tr.Err)
+	}
+	for _, w := range tr.Warnings {
+		level := healthWarn
+		if strings.Contains(w, "broken delegation") {
+			level = healthFail
+		}
+		add(level, "%s", w)
+	}
+	for _, s := range tr.Steps {
+		fr := s.Responses.Fastest()
+		if s.Type != client.ResponseTypeDelegation || fr.Msg == nil {
+			continue
+		}
+		label, servers := client.ParseDelegation(fr.Msg)
+		for _, ns := range servers {
+			if !ns.HasGlue && ns.NeedsGlue(label) {
+				add(healthFail, "%s: in-bailiwick NS %s has no glue", label, ns.Name)
+			}
+		}
+	}
+	for _, gm := range traceGlueMismatches(c, tr) {
+		add(healthWarn, "%s: glue of %s (%s) differs from its authoritative addresses (%s)", gm.Zone, gm.Server,
+			strings.Join(gm.Glue, ","), strings.Join(gm.Authoritative, ","))
+	}
+	if zone == "" || zone == "." {
+		return issues
+	}
+
+	servers, err := c.AuthoritativeNS(zone)
+	if err != nil {
+		add(healthFail, "%s: cannot get name servers: %v", zone, err)
+		return issues
+	}
+	lame := c.LameServers(zone, servers)
+	lameLevel := healthWarn
+	if addrs := countAddrs(servers, c.Family); len(lame) == addrs && addrs > 0 {
+		lameLevel = healthFail
+	}
+	for _, r := range lame {
+		reason := "not authoritative"
+		switch {
+		case r.Err != nil:
+			reason = r.Err.Error()
+		case r.Msg.Rcode != 0:
+			reason = "answers " + dns.RcodeToString[r.Msg.Rcode]
+		}
+		add(lameLevel, "%s: lame server %s(%s): %s", zone, r.Server.Name, r.Addr, reason)
+	}
+	if nc, err := c.CompareNS(zone); err != nil {
+		add(healthWarn, "%s: cannot compare NS: %v", zone, err)
+	} else if !nc.Match() {
+		add(healthWarn, "%s: parent and child NS sets differ (parent only: %s, child only: %s)", zone,
+			strings.Join(nc.ParentOnly, ","), strings.Join(nc.ChildOnly, ","))
+	}
+	rd := client.CheckRedundancy(zone, servers)
+	if rd.SinglePointOfFailure() {
+		add(healthWarn, "%s: name servers are a single point of failure", zone)
+	}
+	add(healthPass, "%s", prefixSummary(rd))
+	return issues
+}
+
+// printHealth prints the verdict of issues for zone and returns false if it
+// is FAIL.
+func printHealth(zone string, issues []healthIssue, col func(s interface{}, c client.Color) string) bool {
+	verdict := healthPass
+	for _, i := range issues {
+		if i.level > verdict {
+			verdict = i.level
+		}
+	}
+	colors := [...]client.Color{client.ColorGreen, client.ColorYellow, client.ColorRed}
+	fmt.Println()
+	fmt.Printf("%s %s\n", col("HEALTH "+healthVerdicts[verdict], colors[verdict]), zone)
+	for _, i := range issues {
+		fmt.Printf("  %s %s\n", col(healthVerdicts[i.level], colors[i.level]), i.msg)
+	}
+	return verdict != healthFail
+}
+
+// countAddrs returns the number of addresses of servers queried with family:
+// 4, 6 or 0 for both.
+func countAddrs(servers []client.Server, family int) (n int) {
+	for _, s := range servers {
+		for _, addr := range s.Addrs {
+			if ip := net.ParseIP(addr); family == 0 || (ip.To4() != nil) == (family == 4) {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,153 +20,1194 @@ import (
 )
 
 const (
-	cReset    = 0
-	cBold     = 1
-	cRed      = 31
-	cGreen    = 32
-	cYellow   = 33
-	cBlue     = 34
-	cMagenta  = 35
-	cCyan     = 36
-	cGray     = 37
-	cDarkGray = 90
-
 	maxRetry = 10 // limit retry of unresolved name to 10 times
+
+	exitUnexpected  = 2   // exit code when the answer does not match expectations
+	exitUnhealthy   = 3   // exit code when the -health verdict is FAIL
+	exitSlow        = 4   // exit code when the trace exceeds -warn-slow
+	exitInterrupted = 130 // exit code when interrupted by a signal
 )
 
-func colorize(s interface{}, color int, enabled bool) string {
-	if !enabled {
-		return fmt.Sprintf("%v", s)
+// seedZone adds the zone@server delegation described by spec to the cache of c
+// so traces for names under zone start from server.
+func seedZone(c *client.Client, spec string) error {
+	i := strings.LastIndexByte(spec, '@')
+	if i <= 0 || i == len(spec)-1 {
+		return fmt.Errorf("invalid -from-zone %q: expected zone@server", spec)
+	}
+	zone, host := dns.Fqdn(spec[:i]), spec[i+1:]
+	s := client.Server{Name: host}
+	if ip := net.ParseIP(host); ip != nil {
+		s.Addrs = []string{ip.String()}
+	} else {
+		s.Name = dns.Fqdn(host)
+		s.Addrs, s.LookupRTT = c.LookupHost(s.Name)
+		if len(s.Addrs) == 0 {
+			return fmt.Errorf("cannot resolve %s seed server %s", zone, s.Name)
+		}
+	}
+	c.DCache.Add(zone, s)
+	return nil
+}
+
+// addOverride adds the zone=server override described by spec to c.
+func addOverride(c *client.Client, spec string) error {
+	i := strings.IndexByte(spec, '=')
+	if i <= 0 || i == len(spec)-1 {
+		return fmt.Errorf("invalid -override %q: expected zone=server", spec)
+	}
+	zone, host := strings.ToLower(dns.Fqdn(spec[:i])), spec[i+1:]
+	s := client.Server{Name: dns.Fqdn(host)}
+	if ip := net.ParseIP(host); ip != nil {
+		s = client.Server{Name: ip.String(), Addrs: []string{ip.String()}}
+	}
+	if c.Overrides == nil {
+		c.Overrides = map[string][]client.Server{}
+	}
+	c.Overrides[zone] = append(c.Overrides[zone], s)
+	return nil
+}
+
+// errUsage is returned by parseArgs when the arguments do not match the usage.
+var errUsage = errors.New("usage: [qtype...] <domain>")
+
+// parseArgs returns the domain and query types of args. Types default to A.
+func parseArgs(args []string) (qname string, qtypes []uint16, err error) {
+	for _, arg := range args {
+		if t, found := dns.StringToType[arg]; found {
+			qtypes = append(qtypes, t)
+			continue
+		}
+		if qname != "" {
+			return "", nil, errUsage
+		}
+		if qname, err = parseName(arg); err != nil {
+			return "", nil, err
+		}
+	}
+	if qname == "" {
+		return "", nil, errUsage
+	}
+	if len(qtypes) == 0 {
+		qtypes = []uint16{guessType(qname)}
 	}
-	return fmt.Sprintf("\x1b[%dm%v\x1b[0m", color, s)
+	return qname, qtypes, nil
+}
+
+// serverArg removes the @server argument from args and returns the server,
+// or "" if there is none.
+func serverArg(args []string) (server string, rest []string) { // nolint: nonamedreturns
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") && len(arg) > 1 {
+			server = arg[1:]
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return server, rest
+}
+
+// hasType returns true if args include a query type.
+func hasType(args []string) bool {
+	for _, arg := range args {
+		if _, found := dns.StringToType[arg]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// guessType returns the record type usually queried for name: TXT for DMARC,
+// DKIM and MTA-STS names, TLSA for _port._proto names, SRV for other
+// _service._proto names, PTR for reverse names and A otherwise.
+func guessType(name string) uint16 {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	switch {
+	case len(labels) == 0:
+		return dns.TypeA
+	case labels[0] == "_dmarc" || labels[0] == "_mta-sts":
+		return dns.TypeTXT
+	case strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa."):
+		return dns.TypePTR
+	}
+	for _, label := range labels {
+		if label == "_domainkey" {
+			return dns.TypeTXT
+		}
+	}
+	if len(labels) > 2 && strings.HasPrefix(labels[0], "_") {
+		switch labels[1] {
+		case "_tcp", "_udp", "_sctp":
+			if _, err := strconv.ParseUint(labels[0][1:], 10, 16); err == nil {
+				return dns.TypeTLSA
+			}
+			return dns.TypeSRV
+		}
+	}
+	return dns.TypeA
+}
+
+// parseName validates arg and returns it as a fully qualified domain name.
+// Underscore labels used by services (_dmarc, _25._tcp) are valid while "*" is
+// only accepted as the whole leftmost label.
+func parseName(arg string) (string, error) {
+	name := dns.Fqdn(arg)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("invalid domain name %q", arg)
+	}
+	for i, label := range dns.SplitDomainName(name) {
+		if strings.Contains(label, "*") && (i > 0 || label != "*") {
+			return "", fmt.Errorf("invalid domain name %q: \"*\" is only valid as the whole leftmost label", arg)
+		}
+	}
+	return name, nil
 }
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: dnstrace [qtype] <domain>\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: dnstrace [qtype...] <domain>\n       dnstrace [-opcode opcode] [qtype...] <domain> @<server>\n       dnstrace -i\n       dnstrace -batch <file>\n       dnstrace -serve <addr>\n\n")
 		flag.PrintDefaults()
 	}
 }
 
+// options holds the command line flags affecting the trace output.
+type options struct {
+	color        bool
+	palette      client.Palette
+	format       string
+	verbose      bool
+	familyReport bool
+	percentiles  bool
+	checkNS      bool
+	checkGlue    bool
+	checkSPOF    bool
+	fingerprint  bool
+	checkAlias   bool
+	health       bool
+	portReport   bool
+	waterfall    bool
+	explain      bool
+	resolve      bool
+	honorTTL     bool
+	finalOnly    bool
+	sort         bool
+	serialOutput bool
+	delegation   bool
+	warnSlow     time.Duration
+	doh          string
+	opcode       int
+	both         bool
+	maxAnswers   int
+	expect       listFlag
+	expectRcode  string
+	statsJSON    string
+	pcap         string
+	jsonLocal    bool
+	jsonMs       bool
+	ednsOpts     []*dns.EDNS0_LOCAL
+	asClient     net.IP
+	geo          *client.GeoDB
+}
+
+func (o options) col(s interface{}, c client.Color) string {
+	return o.palette.Colorize(s, c, o.color)
+}
+
+func (o options) textOptions() client.TextOptions {
+	return client.TextOptions{
+		Color:        o.color,
+		Palette:      o.palette,
+		Verbose:      o.verbose,
+		FamilyReport: o.familyReport,
+		CheckGlue:    o.checkGlue,
+		Percentiles:  o.percentiles,
+		Geo:          o.geo,
+		SortServers:  o.serialOutput,
+	}
+}
+
 func main() {
-	color := flag.Bool("color", true, "Enable/disable colors")
+	var o options
+	flag.BoolVar(&o.color, "color", true, "Enable/disable colors")
+	theme := flag.String("theme", "dark", "Color `theme`: dark, light or none")
+	flag.StringVar(&o.format, "format", formatLong, "Answer output `format`: long, short, dig or zone (answer and delegations as a zone file fragment)")
+	flag.BoolVar(&o.verbose, "verbose", false, "Show raw record details and EDNS options of responses")
+	noCache := flag.Bool("no-cache", false, "Do not reuse cached delegations and name server addresses")
+	strict := flag.Bool("strict", false, "Report referrals with the AA bit set, answer records or missing glue for in-bailiwick name servers")
+	strictAbort := flag.Bool("strict-abort", false, "Like -strict but abort the trace at the first invalid referral")
+	flag.BoolVar(&o.honorTTL, "honor-ttl", false, "Expire cached delegations and addresses after their TTL, as a caching resolver does, when caches are kept between queries (-i, -watch)")
+	answerCache := flag.Bool("answer-cache", false, "Reuse the responses of each step until their TTL expires when caches are kept between queries (-i, -batch, -serve, -watch with -honor-ttl)")
+	minTTL := flag.Duration("min-ttl", 0, "With -honor-ttl or -answer-cache, keep cache entries at least `duration`")
+	maxTTL := flag.Duration("max-ttl", 0, "With -honor-ttl or -answer-cache, keep cache entries at most `duration`")
+	use0x20 := flag.Bool("0x20", false, "Randomize the letter case of query names and flag responses not echoing it (dns-0x20 anti-spoofing)")
+	only4 := flag.Bool("4", false, "Query IPv4 server addresses only")
+	only6 := flag.Bool("6", false, "Query IPv6 server addresses only")
+	readBuffer := flag.Int("read-buffer", 0, "Socket receive buffer size in `bytes` (0 for the system default, capped by net.core.rmem_max on Linux)")
+	writeBuffer := flag.Int("write-buffer", 0, "Socket send buffer size in `bytes` (0 for the system default, capped by net.core.wmem_max on Linux)")
+	retryRcodes := flag.String("retry-rcodes", "servfail,refused", "Comma separated `rcodes` making the trace use the response of another server of the step, or none (NOERROR and NXDOMAIN are never retried)")
+	transport := flag.String("transport", "udp", "Query `transport`: udp, tcp, tls (DNS over TLS on port 853), a comma separated list tried in order on truncation or timeout, or auto for udp,tcp")
+	serversPerStep := flag.Int("servers-per-step", 0, "Query at most `n` name servers at each step (0 for all)")
+	firstAnswer := flag.Bool("first-answer", false, "Use the first response of each step instead of waiting for all servers")
+	retryBackoff := flag.Duration("retry-backoff", 0, "Wait `delay`, doubled on each attempt, before retrying a failed name server lookup")
+	fastLookup := flag.Bool("fast-lookup", false, "Use the first address family resolved for glue-less name servers instead of waiting for both")
+	flag.BoolVar(&o.familyReport, "family-report", false, "Report IPv4 and IPv6 RTT of each server and flag servers reachable on one family only")
+	flag.BoolVar(&o.percentiles, "percentiles", false, "Report the p50, p90 and p99 RTT of the servers queried at each step")
+	flag.BoolVar(&o.checkNS, "check-ns", false, "Compare the NS set delegated by the parent zone with the one returned by the zone")
+	flag.BoolVar(&o.checkSPOF, "check-spof", false, "Warn when all name servers of the zone share the same address or network")
+	flag.BoolVar(&o.checkAlias, "check-alias", false, "Note zone apex addresses pointing back outside of the zone, as flattened ALIAS records do")
+	flag.BoolVar(&o.fingerprint, "fingerprint", false, "Query the version.bind and hostname.bind of the name servers of the zone")
+	flag.BoolVar(&o.health, "health", false, "Check the delegation, glue, name servers and redundancy of the zone and print a PASS/WARN/FAIL verdict")
+	flag.BoolVar(&o.portReport, "port-report", false, "Report the distribution of the source ports of the queries and flag non-randomized ports")
+	flag.BoolVar(&o.checkGlue, "check-glue", false, "Flag in-bailiwick name servers delegated without glue or with glue differing from their authoritative addresses")
+	flag.BoolVar(&o.finalOnly, "final-only", false, "Only print the answer records of the requested type at the end of the CNAME chain")
+	opcode := flag.String("opcode", "QUERY", "Query `opcode`: QUERY, NOTIFY or STATUS; other than QUERY, the query is sent to the @server given after the domain instead of being traced")
+	flag.StringVar(&o.doh, "doh", "", "Compare the answer with the one of the DNS over HTTPS resolver at `url` (like https://dns.example/dns-query)")
+	flag.DurationVar(&o.warnSlow, "warn-slow", 0, "Warn and exit with status 4 when the cold best path time exceeds `duration`")
+	flag.BoolVar(&o.delegation, "delegation", false, "Only print the name servers and SOA serials of the zone the domain belongs to, without querying the domain")
+	flag.BoolVar(&o.serialOutput, "serial-output", false, "List the servers of each step by name then address instead of in completion order, for reproducible output")
+	flag.BoolVar(&o.sort, "sort", false, "Sort the answer records by type and data instead of keeping the order returned by the server")
+	flag.IntVar(&o.maxAnswers, "max-answers", 0, "Print at most `n` answer records (0 for no limit)")
+	flag.BoolVar(&o.both, "both", false, "For A and AAAA queries, also resolve the other address family")
+	flag.BoolVar(&o.resolve, "resolve-targets", false, "Resolve the addresses of MX and SRV targets and follow NAPTR S and A replacements")
+	flag.Var(&o.expect, "expect", "Exit with an error if the answer does not contain `value` (repeatable)")
+	flag.StringVar(&o.expectRcode, "expect-rcode", "", "Exit with an error if the answer `rcode` differs (e.g. NXDOMAIN)")
+	flag.StringVar(&o.statsJSON, "stats-json", "", "Also write the structured trace as JSON to `path`")
+	flag.StringVar(&o.pcap, "pcap", "", "Also write the exchanges of the trace as a pcap file to `path` (synthetic UDP packets)")
+	flag.BoolVar(&o.jsonLocal, "json-local-time", false, "Write JSON timestamps in local time instead of UTC")
+	flag.BoolVar(&o.jsonMs, "json-ms", false, "Write JSON timestamps with millisecond instead of nanosecond precision")
+	flag.BoolVar(&o.explain, "explain", false, "Narrate each step of the trace in plain English instead of the detailed output")
+	flag.BoolVar(&o.waterfall, "waterfall", false, "Output a CSV timing waterfall of all exchanges instead of the trace")
+	maxNS := flag.Int("max-ns", client.DefaultMaxDelegationServers, "Maximum number of NS records processed per delegation (0 for no limit)")
+	geoDB := flag.String("geo-db", "", "Annotate server addresses with the ASN and country found in the network,asn,country CSV file at `path`")
+	asClient := flag.String("as-client", "", "Send the EDNS Client Subnet of client `IP` (/24 or /56) and compare the answer with the one without it")
+	var ednsOpts listFlag
+	flag.Var(&ednsOpts, "ednsopt", "Add an EDNS0 option to queries as `code[:hexdata]` (repeatable)")
+	var rootAddrs listFlag
+	flag.Var(&rootAddrs, "root", "Start traces from the root server at `address` instead of the IANA roots (repeatable)")
+	var overrides listFlag
+	flag.Var(&overrides, "override", "Query only `zone=server` (address or name) when the trace reaches zone (repeatable)")
+	fromZone := flag.String("from-zone", "", "Start the trace at `zone@server` instead of the root servers")
+	maxSize := flag.Int("max-response-size", 0, "Warn about responses larger than `bytes` (0 for no limit)")
+	dropOversized := flag.Bool("drop-oversized", false, "Ignore responses larger than -max-response-size")
+	debug := flag.Bool("debug", false, "Log resolver decisions to stderr")
+	dryRun := flag.Bool("dry-run", false, "Print the zone and name servers the trace would start from without querying them")
+	maxCachedNS := flag.Int("max-cached-ns", client.DefaultMaxCachedServers, "Maximum number of name servers kept in the delegation cache (0 for no limit)")
+	watchInterval := flag.Duration("watch", 0, "Resolve again every `interval` and report answer changes")
+	interactive := flag.Bool("i", false, "Read queries from the standard input, keeping caches between them")
+	batch := flag.String("batch", "", "Trace each `file` line of the form [qtype...] <domain> (- for the standard input)")
+	failFast := flag.Bool("fail-fast", false, "In batch mode, stop at the first failed trace instead of tracing all names")
+	serveAddr := flag.String("serve", "", "Serve JSON traces over HTTP on `addr`, at /trace?name=<domain>&type=<qtype>, sharing the caches between requests (see -honor-ttl)")
+	serveTimeout := flag.Duration("serve-timeout", 10*time.Second, "With -serve, abort traces taking longer than `duration`")
 	flag.Parse()
 
-	if flag.NArg() < 1 || flag.NArg() > 2 {
+	if flag.NArg() < 1 && !*interactive && *batch == "" && *serveAddr == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
-	qname := ""
-	qtype := dns.TypeA
-	for _, arg := range flag.Args() {
-		if t, found := dns.StringToType[arg]; found {
-			qtype = t
-			continue
+	if *theme == "none" {
+		o.color = false
+	} else if p, found := client.Themes[*theme]; found {
+		o.palette = p
+	} else {
+		fmt.Fprintf(os.Stderr, "invalid -theme %q\n", *theme)
+		os.Exit(1)
+	}
+	switch o.format {
+	case formatLong, formatShort, formatDig, formatZone:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -format %q\n", o.format)
+		os.Exit(1)
+	}
+	for _, spec := range ednsOpts {
+		e, err := parseEDNSOpt(spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		if qname != "" {
+		o.ednsOpts = append(o.ednsOpts, e)
+	}
+	if *geoDB != "" {
+		var err error
+		if o.geo, err = loadGeoDB(*geoDB); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -geo-db: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *asClient != "" {
+		if o.asClient = net.ParseIP(*asClient); o.asClient == nil {
+			fmt.Fprintf(os.Stderr, "invalid -as-client %q: expected an IP address\n", *asClient)
+			os.Exit(1)
+		}
+	}
+	var qname string
+	var qtypes []uint16
+	switch oc := strings.ToUpper(*opcode); oc {
+	case "QUERY", "NOTIFY", "STATUS":
+		o.opcode = dns.StringToOpcode[oc]
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -opcode %q: expected QUERY, NOTIFY or STATUS\n", *opcode)
+		os.Exit(1)
+	}
+	var server string
+	if !*interactive && *batch == "" && *serveAddr == "" {
+		args := flag.Args()
+		server, args = serverArg(args)
+		var err error
+		if qname, qtypes, err = parseArgs(args); errors.Is(err, errUsage) {
 			flag.Usage()
 			os.Exit(1)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if o.opcode == dns.OpcodeNotify && !hasType(args) {
+			qtypes = []uint16{dns.TypeSOA} // RFC 1996 section 3.7
+		}
+	}
+	// Only the REPL can send queries to a single server besides @server.
+	if o.opcode != dns.OpcodeQuery && server == "" && !*interactive {
+		fmt.Fprintf(os.Stderr, "-opcode %s requires an @server: only QUERY can be traced\n", dns.OpcodeToString[o.opcode])
+		os.Exit(1)
+	}
+
+	c := client.New(maxRetry)
+	c.Client.Timeout = 500 * time.Millisecond
+	transports, err := parseTransports(*transport)
+	if err != nil {
+		fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+		os.Exit(1)
+	}
+	c.Net = transports[0]
+	if len(transports) > 1 {
+		c.Transports = transports
+	}
+	c.RetryRcodes, err = parseRcodes(*retryRcodes)
+	if err != nil {
+		fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+		os.Exit(1)
+	}
+	c.ReadBuffer, c.WriteBuffer = *readBuffer, *writeBuffer
+	c.Strict, c.StrictAbort = *strict, *strictAbort
+	c.Use0x20 = *use0x20
+	switch {
+	case *only4 && *only6:
+		fmt.Fprintln(os.Stderr, "-4 and -6 are mutually exclusive")
+		os.Exit(1)
+	case *only4:
+		c.Family = 4
+	case *only6:
+		c.Family = 6
+	default:
+		switch v4, v6 := client.UsableFamilies(); {
+		case v4 && !v6:
+			c.Family = 4
+			fmt.Fprintln(os.Stderr, "! no IPv6 route, querying IPv4 addresses only")
+		case v6 && !v4:
+			c.Family = 6
+			fmt.Fprintln(os.Stderr, "! no IPv4 route, querying IPv6 addresses only")
+		}
+	}
+	c.MaxDelegationServers = *maxNS
+	c.DCache.MaxServers = *maxCachedNS
+	if o.honorTTL {
+		ttl := client.TTLPolicy{Honor: true, Min: *minTTL, Max: *maxTTL}
+		c.DCache.TTL, c.LCache.TTL = ttl, ttl
+	}
+	if *answerCache {
+		c.ACache = &client.AnswerCache{TTL: client.TTLPolicy{Min: *minTTL, Max: *maxTTL}}
+	}
+	if *noCache && *fromZone != "" {
+		// Seeded delegations would be dropped with the cache of each query.
+		fmt.Fprintln(os.Stderr, "-no-cache and -from-zone are mutually exclusive")
+		os.Exit(1)
+	}
+	if *watchInterval > 0 && *fromZone != "" && !o.honorTTL {
+		// Caches are reset between watch cycles, seeded delegations included.
+		fmt.Fprintln(os.Stderr, "-watch and -from-zone are mutually exclusive without -honor-ttl")
+		os.Exit(1)
+	}
+	c.NoCache = *noCache
+	c.FastLookup = *fastLookup
+	c.FirstAnswer = *firstAnswer
+	c.MaxServersPerStep = *serversPerStep
+	c.RetryBackoff = *retryBackoff
+	c.MaxResponseSize = *maxSize
+	c.DropOversized = *dropOversized
+	if *debug {
+		c.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	if len(rootAddrs) > 0 {
+		var rs []client.Server
+		for _, addr := range rootAddrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				fmt.Printf(o.col("*** error: invalid -root %q: expected an IP address\n", client.ColorRed), addr)
+				os.Exit(1)
+			}
+			rs = append(rs, client.Server{Name: ip.String(), HasGlue: true, Addrs: []string{ip.String()}})
+		}
+		c.SetRoots(rs)
+	}
+	for _, spec := range overrides {
+		if err := addOverride(&c, spec); err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			os.Exit(1)
 		}
-		qname = dns.Fqdn(arg)
+	}
+	if *fromZone != "" {
+		if err := seedZone(&c, *fromZone); err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			os.Exit(1)
+		}
+	}
+
+	if *interactive {
+		repl(&c, os.Stdin, o)
+		return
 	}
 
-	col := func(s interface{}, c int) string {
-		return colorize(s, c, *color)
+	if *dryRun {
+		printPlan(&c, qname, qtypes, o.col)
+		return
 	}
 
+	if strings.HasPrefix(qname, "*.") {
+		fmt.Println(o.col("! "+qname+" queries the wildcard record itself, not a name it covers", client.ColorYellow))
+		fmt.Println()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if server != "" {
+		s, err := replServer(&c, server)
+		if err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			os.Exit(1)
+		}
+		os.Exit(queryName(ctx, &c, s, qname, qtypes, o))
+	}
+
+	if *serveAddr != "" {
+		if err := serve(ctx, &c, *serveAddr, *serveTimeout, o); err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *batch != "" {
+		os.Exit(runBatch(ctx, &c, *batch, *failFast, o))
+	}
+
+	if *watchInterval > 0 {
+		watch(ctx, &c, qname, qtypes, *watchInterval, o)
+		return
+	}
+
+	os.Exit(traceName(ctx, &c, qname, qtypes, o))
+}
+
+// traceName traces each of qtypes for qname and returns the exit code.
+func traceName(ctx context.Context, c *client.Client, qname string, qtypes []uint16, o options) int {
+	if o.delegation {
+		err := delegation(ctx, c, qname, o)
+		if ctx.Err() != nil {
+			fmt.Println(o.col("\n(interrupted)", client.ColorYellow))
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			return 1
+		}
+		return 0
+	}
+	exitCode := 0
+	for i, qtype := range qtypes {
+		if len(qtypes) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Println(o.col(fmt.Sprintf(";;; %s %s", dns.TypeToString[qtype], qname), client.ColorBold))
+			fmt.Println()
+		}
+		m := newQuery(qname, qtype, o)
+		err := trace(ctx, c, m, o)
+		if ctx.Err() != nil {
+			fmt.Println(o.col("\n(interrupted)", client.ColorYellow))
+			os.Exit(exitInterrupted)
+		}
+		if errors.Is(err, errUnexpected) {
+			exitCode = exitUnexpected
+		} else if errors.Is(err, errUnhealthy) {
+			exitCode = exitUnhealthy
+		} else if errors.Is(err, errSlow) {
+			exitCode = exitSlow
+		} else if err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+// queryName sends the queries of qname for each of qtypes to s only, without
+// tracing, and returns the exit code.
+func queryName(ctx context.Context, c *client.Client, s client.Server, qname string, qtypes []uint16, o options) int {
+	exitCode := 0
+	for i, qtype := range qtypes {
+		if i > 0 {
+			fmt.Println()
+		}
+		err := queryServer(ctx, c, s, newQuery(qname, qtype, o), o)
+		if ctx.Err() != nil {
+			fmt.Println(o.col("\n(interrupted)", client.ColorYellow))
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+// loadGeoDB loads the geolocation database at path.
+func loadGeoDB(path string) (*client.GeoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return client.LoadGeoDB(f)
+}
+
+// parseRcodes parses the -retry-rcodes value.
+func parseRcodes(spec string) ([]int, error) {
+	if spec == "none" || spec == "" {
+		return []int{}, nil
+	}
+	var rcodes []int
+	for _, name := range strings.Split(spec, ",") {
+		rcode, found := dns.StringToRcode[strings.ToUpper(name)]
+		if !found {
+			return nil, fmt.Errorf("invalid -retry-rcodes %q: unknown rcode", name)
+		}
+		if rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError {
+			return nil, fmt.Errorf("invalid -retry-rcodes %q: authoritative answers are never retried", name)
+		}
+		rcodes = append(rcodes, rcode)
+	}
+	return rcodes, nil
+}
+
+// parseTransports parses the -transport value into client networks.
+func parseTransports(spec string) ([]string, error) {
+	if spec == "auto" {
+		spec = "udp,tcp"
+	}
+	var transports []string
+	for _, t := range strings.Split(spec, ",") {
+		switch t {
+		case "udp", "tcp":
+			transports = append(transports, t)
+		case "tls":
+			transports = append(transports, "tcp-tls")
+		default:
+			return nil, fmt.Errorf("invalid -transport %q: expected udp, tcp, tls, a list of them or auto", t)
+		}
+	}
+	return transports, nil
+}
+
+// newQuery creates the query message for qname and qtype.
+func newQuery(qname string, qtype uint16, o options) *dns.Msg {
 	m := &dns.Msg{}
 	m.SetQuestion(qname, qtype)
+	if o.opcode != dns.OpcodeQuery {
+		m.Opcode = o.opcode
+		m.RecursionDesired = false
+		// NOTIFY is sent by the primary, authoritative for the zone.
+		m.Authoritative = o.opcode == dns.OpcodeNotify
+	}
 	// Set DNSSEC opt to better emulate the default queries from a nameserver.
-	o := &dns.OPT{
+	opt := &dns.OPT{
 		Hdr: dns.RR_Header{
 			Name:   ".",
 			Rrtype: dns.TypeOPT,
 		},
 	}
-	o.SetDo()
-	o.SetUDPSize(dns.DefaultMsgSize)
-	m.Extra = append(m.Extra, o)
+	opt.SetDo()
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	for _, e := range o.ednsOpts {
+		opt.Option = append(opt.Option, e)
+	}
+	if o.asClient != nil {
+		opt.Option = append(opt.Option, clientSubnet(o.asClient))
+	}
+	m.Extra = append(m.Extra, opt)
+	return m
+}
+
+// clientSubnet returns the EDNS Client Subnet option (RFC 7871) of ip
+// truncated to /24 for IPv4 or /56 for IPv6, as recommended for privacy.
+func clientSubnet(ip net.IP) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 56}
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family, e.SourceNetmask = 1, 24
+		ip = ip4
+	}
+	e.Address = ip.Mask(net.CIDRMask(int(e.SourceNetmask), len(ip)*8))
+	return e
+}
 
-	c := client.New(maxRetry)
-	c.Client.Timeout = 500 * time.Millisecond
-	t := client.Tracer{
+// parseEDNSOpt parses a code:hex EDNS0 option specification.
+func parseEDNSOpt(spec string) (*dns.EDNS0_LOCAL, error) {
+	i := strings.IndexByte(spec, ':')
+	if i < 0 {
+		i = len(spec)
+	}
+	code, err := strconv.ParseUint(spec[:i], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -ednsopt %q: bad option code", spec)
+	}
+	var data []byte
+	if i < len(spec) {
+		if data, err = hex.DecodeString(spec[i+1:]); err != nil {
+			return nil, fmt.Errorf("invalid -ednsopt %q: bad hex payload", spec)
+		}
+	}
+	return &dns.EDNS0_LOCAL{Code: uint16(code), Data: data}, nil
+}
+
+// errNotTraceable is returned when tracing a query other than a QUERY.
+var errNotTraceable = errors.New("only QUERY can be traced")
+
+// errSlow is returned when the cold best path time exceeds -warn-slow.
+var errSlow = errors.New("trace is slow")
+
+// trace runs a recursive query for m using c and prints the trace, a summary
+// and the answer.
+// nolint: funlen,gocyclo,gocognit
+func trace(ctx context.Context, c *client.Client, m *dns.Msg, o options) error {
+	if m.Opcode != dns.OpcodeQuery {
+		return fmt.Errorf("%w: opcode %s, send it to an @server", errNotTraceable, dns.OpcodeToString[m.Opcode])
+	}
+	col := o.col
+	// Time of the best path spent resolving NS names vs querying zones.
+	var lookupTime, queryTime time.Duration
+	// CNAME chain hops, zones serving the names of the chain and best path
+	// time of each name followed, starting with the queried one.
+	var cnameHops int
+	var cnameZones []string
+	segments := cnameSegments{{zone: m.Question[0].Name}}
+	// Zone of the last step.
+	var finalZone string
+	// NS records of the delegations followed.
+	var delegations []dns.RR
+	// Best path time spent per zone, in query order.
+	var zoneTimes []zoneTime
+	// Step of the best path taking the most time.
+	var slowest struct {
+		step int
+		zone string
+		time time.Duration
+	}
+	stats := client.Tracer{
 		GotIntermediaryResponse: func(i int, m *dns.Msg, rs client.Responses, rtype client.ResponseType) {
 			fr := rs.Fastest()
-			var r *dns.Msg
-			if fr != nil {
-				r = fr.Msg
+			if fr.Msg == nil {
+				return
 			}
-			qname := m.Question[0].Name
-			qtype := dns.TypeToString[m.Question[0].Qtype]
-			if i > 1 {
-				fmt.Println()
-			}
-			fmt.Printf("%d - query %s %s", i, qtype, qname)
-			if r != nil {
-				fmt.Printf(": %s", strings.Replace(strings.Replace(r.MsgHdr.String(), ";; ", "", -1), "\n", ", ", -1))
-			}
-			fmt.Println()
-			for _, pr := range rs {
-				ln := 0
-				if pr.Msg != nil {
-					ln = pr.Msg.Len()
-				}
-				rtt := float64(pr.RTT) / float64(time.Millisecond)
-				lrtt := "0ms (from cache)"
-				if pr.Server.HasGlue {
-					lrtt = "0ms (from glue)"
-				} else if pr.Server.LookupRTT > 0 {
-					lrtt = fmt.Sprintf("%.2fms", float64(pr.Server.LookupRTT)/float64(time.Millisecond))
-				}
-				fmt.Printf(col("  - %d bytes in %.2fms + %s lookup on %s(%s)", cDarkGray), ln, rtt, lrtt, pr.Server.Name, pr.Addr)
-				if pr.Err != nil {
-					err := pr.Err
-					if oerr, ok := err.(*net.OpError); ok {
-						err = oerr.Err
-					}
-					fmt.Printf(": %v", col(err, cRed))
-				}
-				fmt.Print("\n")
+			lookupTime += fr.Server.LookupRTT
+			queryTime += fr.RTT
+			zoneTimes = addZoneTime(zoneTimes, fr.Zone, fr.Server.LookupRTT+fr.RTT)
+			finalZone = fr.Zone
+			if d := fr.Server.LookupRTT + fr.RTT; d > slowest.time {
+				slowest.step, slowest.zone, slowest.time = i, fr.Zone, d
 			}
-
 			switch rtype {
 			case client.ResponseTypeDelegation:
-				var label string
-				for _, rr := range r.Ns {
-					if ns, ok := rr.(*dns.NS); ok {
-						label = ns.Header().Name
-						break
+				for _, rr := range fr.Msg.Ns {
+					if _, ok := rr.(*dns.NS); ok {
+						delegations = append(delegations, rr)
 					}
 				}
-				_, ns := c.DCache.Get(label)
-				for _, s := range ns {
-					var glue string
-					if s.HasGlue {
-						glue = col("glue: "+strings.Join(s.Addrs, ","), cDarkGray)
-					} else {
-						glue = col("no glue", cYellow)
-					}
-					fmt.Printf("%s %d NS %s (%s)\n", label, s.TTL, s.Name, glue)
-				}
 			case client.ResponseTypeCNAME:
-				for _, rr := range r.Answer {
-					fmt.Println(rr)
+				cnameZones = appendUnique(cnameZones, fr.Zone)
+			case client.ResponseTypeFinal:
+				if cnameHops > 0 {
+					cnameZones = appendUnique(cnameZones, fr.Zone)
 				}
 			}
 		},
 		FollowingCNAME: func(domain, target string) {
-			fmt.Printf(col("\n~ following CNAME %s -> %s\n", cBlue), domain, target)
+			cnameHops++
 		},
 	}
-	r, rtt, err := c.RecursiveQuery(m, t)
+	text := client.NewTextTracer(os.Stdout, o.textOptions())
+	if o.explain {
+		text = client.NewExplainTracer(os.Stdout)
+	}
+	var steps []client.Responses
+	if o.waterfall {
+		text = client.Tracer{
+			GotIntermediaryResponse: func(i int, m *dns.Msg, rs client.Responses, rtype client.ResponseType) {
+				steps = append(steps, rs)
+			},
+		}
+	}
+	rec := client.NewTrace(m.Question[0])
+	if o.jsonLocal {
+		rec.TimeLocation = time.Local
+	}
+	if o.jsonMs {
+		rec.TimeLayout = client.RFC3339Milli
+	}
+	t := client.MultiTracer(stats, segments.tracer(), text, rec.Tracer())
+	start := time.Now()
+	var other chan *dns.Msg
+	if o.both && (m.Question[0].Qtype == dns.TypeA || m.Question[0].Qtype == dns.TypeAAAA) {
+		om := m.Copy()
+		om.Question[0].Qtype = dns.TypeAAAA
+		if m.Question[0].Qtype == dns.TypeAAAA {
+			om.Question[0].Qtype = dns.TypeA
+		}
+		other = make(chan *dns.Msg, 1)
+		go func() {
+			r, _, _ := c.RecursiveQueryContext(ctx, om, client.Tracer{})
+			other <- r
+		}()
+	}
+	r, rtt, err := c.RecursiveQueryContext(ctx, m, t)
+	rec.Finish(r, rtt, err)
+	if o.statsJSON != "" {
+		if werr := writeJSONFile(o.statsJSON, rec); werr != nil {
+			fmt.Printf(col("*** cannot write %s: %v\n", client.ColorRed), o.statsJSON, werr)
+		}
+	}
+	if o.pcap != "" {
+		if werr := writePcapFile(o.pcap, m, rec); werr != nil {
+			fmt.Printf(col("*** cannot write %s: %v\n", client.ColorRed), o.pcap, werr)
+		}
+	}
+	if o.waterfall {
+		writeWaterfall(os.Stdout, start, steps)
+	}
 	if err != nil {
-		fmt.Printf(col("*** error: %v\n", cRed), err)
-		os.Exit(1)
+		if o.health {
+			printHealth(finalZone, checkHealth(c, rec, finalZone), col)
+			return errUnhealthy
+		}
+		return err
+	}
+	if o.waterfall {
+		return nil
 	}
 
 	fmt.Println()
-	fmt.Printf(col(";; Cold best path time: %s\n\n", cGray), rtt)
+	if len(segments) > 1 {
+		// rtt covers the path of each name of the chain.
+		fmt.Printf(col(";; Cold best path time: %s in total, %s of which following CNAMEs\n", client.ColorGray), rtt, rtt-segments[0].time)
+		width := 0
+		for _, seg := range segments {
+			if len(seg.zone) > width {
+				width = len(seg.zone)
+			}
+		}
+		for _, seg := range segments {
+			fmt.Printf(col(";;   %-*s %10s\n", client.ColorGray), width, seg.zone, seg.time)
+		}
+	} else {
+		fmt.Printf(col(";; Cold best path time: %s\n", client.ColorGray), rtt)
+	}
+	fmt.Printf(col(";; NS name resolution: %s, zone queries: %s\n", client.ColorGray), lookupTime, queryTime)
+	if cnameHops > 0 {
+		fmt.Printf(col(";; CNAME chain: %d hop(s) across %d zone(s)\n", client.ColorGray), cnameHops, len(cnameZones))
+	}
+	if len(rec.Chain) > 1 {
+		fmt.Printf(col(";; %s\n", client.ColorGray), strings.Join(rec.Chain, " -> "))
+	}
+	printZoneTimes(zoneTimes, col)
+	slow := o.warnSlow > 0 && rtt > o.warnSlow
+	if slow {
+		fmt.Printf(col("! slow trace: cold best path time %s exceeds %s, step %d (%s) took the most with %s\n", client.ColorRed),
+			rtt, o.warnSlow, slowest.step, slowest.zone, slowest.time)
+	}
+	fmt.Println()
+	ar := r
+	if o.sort {
+		ar = r.Copy()
+		ar.Answer = sortAnswer(r.Answer)
+	}
+	if o.finalOnly {
+		ar = ar.Copy()
+		ar.Answer = finalAnswer(ar.Answer, m.Question[0])
+	}
+	var more int
+	if o.maxAnswers > 0 && len(ar.Answer) > o.maxAnswers {
+		more = len(ar.Answer) - o.maxAnswers
+		ar = ar.Copy()
+		ar.Answer = ar.Answer[:o.maxAnswers]
+	}
+	if o.format == formatZone {
+		writeZone(os.Stdout, m.Question[0], append(delegations, ar.Answer...))
+	} else {
+		writeAnswer(os.Stdout, ar, rtt, o.format, o.verbose)
+	}
+	if more > 0 {
+		fmt.Printf(col(";; ... and %d more (%d records in total)\n", client.ColorGray), more, len(ar.Answer)+more)
+	}
+	if o.format == formatLong {
+		var lookup func(host string) []string
+		if o.resolve {
+			lookup = func(host string) []string {
+				addrs, _ := c.LookupHost(host)
+				return addrs
+			}
+		}
+		writeMX(os.Stdout, r.Answer, lookup)
+		writeSRV(os.Stdout, r.Answer, lookup)
+		var lookupSRV func(name string) []string
+		if o.resolve {
+			lookupSRV = func(name string) []string {
+				return srvEndpoints(ctx, c, name)
+			}
+		}
+		writeNAPTR(os.Stdout, r.Answer, lookup, lookupSRV)
+		writeCAA(os.Stdout, r.Answer)
+		if other != nil {
+			writeFamilies(os.Stdout, r, <-other)
+		}
+	}
+
+	if (len(o.expect) > 0 || o.expectRcode != "") && !checkExpect(os.Stdout, r, o.expect, o.expectRcode) {
+		err = errUnexpected
+	}
+
+	if o.checkNS && finalZone != "." {
+		nc, err := c.CompareNS(finalZone)
+		if err != nil {
+			fmt.Printf(col("\n*** cannot compare NS of %s: %v\n", client.ColorRed), finalZone, err)
+		} else {
+			printNSComparison(nc, col)
+		}
+	}
+
+	if o.checkSPOF && finalZone != "." {
+		servers, err := c.AuthoritativeNS(finalZone)
+		if err != nil {
+			fmt.Printf(col("\n*** cannot check redundancy of %s: %v\n", client.ColorRed), finalZone, err)
+		} else {
+			printRedundancy(client.CheckRedundancy(finalZone, servers), col)
+		}
+	}
+
+	qtype := m.Question[0].Qtype
+	if o.checkAlias && r != nil && cnameHops == 0 && (qtype == dns.TypeA || qtype == dns.TypeAAAA) &&
+		strings.EqualFold(m.Question[0].Name, finalZone) {
+		if targets := c.AliasTargets(finalZone, r.Answer); len(targets) > 0 {
+			fmt.Println()
+			fmt.Printf(col(";; %s addresses are not behind a CNAME but point back to %s: possibly a flattened ALIAS/ANAME record\n", client.ColorGray),
+				finalZone, strings.Join(targets, ", "))
+		}
+	}
+
+	if o.fingerprint {
+		servers, err := c.AuthoritativeNS(finalZone)
+		if err != nil {
+			fmt.Printf(col("\n*** cannot fingerprint servers of %s: %v\n", client.ColorRed), finalZone, err)
+		} else {
+			printFingerprints(c.Fingerprint(servers), col)
+		}
+	}
+
+	if o.checkGlue {
+		printGlueMismatches(traceGlueMismatches(c, rec), col)
+	}
+
+	if o.portReport {
+		steps := make([]client.Responses, 0, len(rec.Steps))
+		for _, s := range rec.Steps {
+			steps = append(steps, s.Responses)
+		}
+		printPorts(client.SourcePorts(steps...), col)
+	}
+
+	if o.asClient != nil {
+		def := o
+		def.asClient = nil
+		q := m.Question[0]
+		fmt.Println()
+		if base, cur := queryAnswer(ctx, c, q.Name, q.Qtype, def), answerSummary(r, nil); base == cur {
+			fmt.Printf(col(";; Same answer as without client subnet %s\n", client.ColorGray), o.asClient)
+		} else {
+			fmt.Printf(col("! answer differs for client %s:\n", client.ColorYellow), o.asClient)
+			fmt.Printf("- %s\n+ %s\n", col(base, client.ColorRed), col(cur, client.ColorGreen))
+		}
+	}
+
+	if o.doh != "" {
+		dm := m.Copy()
+		dm.RecursionDesired = true
+		dr, drtt, derr := client.DoH{URL: o.doh}.ExchangeContext(ctx, dm, "")
+		// Compare the records at the end of the CNAME chains: the answer of
+		// the trace only holds the last part of the chain.
+		if derr == nil {
+			dr = dr.Copy()
+			dr.Answer = finalAnswer(dr.Answer, dm.Question[0])
+		}
+		tr := r.Copy()
+		tr.Answer = finalAnswer(tr.Answer, dns.Question{Name: rec.Chain[len(rec.Chain)-1], Qtype: m.Question[0].Qtype})
+		fmt.Println()
+		if base, cur := answerSummary(dr, derr), answerSummary(tr, nil); base == cur {
+			fmt.Printf(col(";; Same answer from DoH resolver %s in %s\n", client.ColorGray), o.doh, drtt)
+		} else {
+			fmt.Printf(col("! answer differs from DoH resolver %s:\n", client.ColorYellow), o.doh)
+			fmt.Printf("- %s\n+ %s\n", col(base, client.ColorRed), col(cur, client.ColorGreen))
+		}
+	}
+
+	if o.health && !printHealth(finalZone, checkHealth(c, rec, finalZone), col) && err == nil {
+		err = errUnhealthy
+	}
+	if slow && err == nil {
+		err = errSlow
+	}
+	return err
+}
+
+// printFingerprints prints the software version and host name reported by
+// each server.
+func printFingerprints(fps []client.Fingerprint, col func(s interface{}, c client.Color) string) {
+	fmt.Println()
+	fmt.Println(col(";; Server software:", client.ColorGray))
+	for _, fp := range fps {
+		version := fmt.Sprintf("%q", fp.Version)
+		if fp.Version == "" {
+			version = col("version hidden", client.ColorYellow)
+		}
+		fmt.Printf(";;   %s(%s): %s", fp.Server, fp.Addr, version)
+		if fp.Hostname != "" {
+			fmt.Printf(", hostname %q", fp.Hostname)
+		}
+		fmt.Println()
+	}
+}
+
+// srvEndpoints returns the targets of the SRV records of name as host:port
+// endpoints.
+func srvEndpoints(ctx context.Context, c *client.Client, name string) []string {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+	r, _, err := c.RecursiveQueryContext(ctx, m, client.Tracer{})
+	if err != nil || r == nil {
+		return nil
+	}
+	var eps []string
 	for _, rr := range r.Answer {
-		fmt.Println(rr)
+		if srv, ok := rr.(*dns.SRV); ok && srv.Target != "." {
+			eps = append(eps, net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return eps
+}
+
+// traceGlueMismatches returns the stale glue of the delegations followed by
+// tr.
+func traceGlueMismatches(c *client.Client, tr *client.Trace) []client.GlueMismatch {
+	var mismatches []client.GlueMismatch
+	for _, s := range tr.Steps {
+		fr := s.Responses.Fastest()
+		if s.Type != client.ResponseTypeDelegation || fr.Msg == nil {
+			continue
+		}
+		zone, servers := client.ParseDelegation(fr.Msg)
+		mismatches = append(mismatches, c.CheckGlue(zone, servers)...)
+	}
+	return mismatches
+}
+
+// printGlueMismatches prints a warning for each stale glue.
+func printGlueMismatches(mismatches []client.GlueMismatch, col func(s interface{}, c client.Color) string) {
+	if len(mismatches) == 0 {
+		return
+	}
+	fmt.Println()
+	for _, gm := range mismatches {
+		fmt.Printf(col("! %s: glue of %s (%s) differs from its authoritative addresses (%s)\n", client.ColorYellow),
+			gm.Zone, gm.Server, strings.Join(gm.Glue, ","), strings.Join(gm.Authoritative, ","))
+	}
+}
+
+// printPorts prints the distribution of source ports and an advisory if they do
+// not look randomized.
+func printPorts(ps client.PortStats, col func(s interface{}, c client.Color) string) {
+	fmt.Println()
+	if ps.Queries == 0 {
+		fmt.Println(col(";; Source ports: unknown", client.ColorGray))
+		return
+	}
+	fmt.Printf(col(";; Source ports: %d queries, %d distinct, range %d-%d\n", client.ColorGray), ps.Queries, ps.Distinct, ps.Min, ps.Max)
+	for i, n := range ps.Buckets {
+		bar := strings.Repeat("#", n*20/ps.Queries)
+		fmt.Printf(col(";;   %5d-%-5d %4d %s\n", client.ColorGray), i*8192, i*8192+8191, n, bar)
+	}
+	if !ps.Randomized() {
+		fmt.Println(col("! source ports do not look randomized: queries are easier to spoof", client.ColorYellow))
+	}
+}
+
+// printRedundancy prints an advisory if the zone depends on a single point of
+// failure.
+func printRedundancy(rd client.Redundancy, col func(s interface{}, c client.Color) string) {
+	fmt.Println()
+	switch {
+	case rd.Servers < 2:
+		fmt.Printf(col("! %s is served by a single name server\n", client.ColorYellow), rd.Zone)
+	case rd.SameIP:
+		fmt.Printf(col("! all %d name servers of %s share the same address\n", client.ColorYellow), rd.Servers, rd.Zone)
+	case rd.SamePrefix:
+		fmt.Printf(col("! all %d name servers of %s are in the same network prefix\n", client.ColorYellow), rd.Servers, rd.Zone)
+	default:
+		fmt.Printf(col(";; %s name servers are spread over multiple networks\n", client.ColorGray), rd.Zone)
+	}
+	fmt.Printf(col(";; %s\n", client.ColorGray), prefixSummary(rd))
+}
+
+// prefixSummary describes the distinct network prefixes of the name servers
+// of rd and its redundancy score.
+func prefixSummary(rd client.Redundancy) string {
+	return fmt.Sprintf("%s: %d distinct prefix(es) (%d IPv4 /24, %d IPv6 /48), redundancy %s",
+		rd.Zone, rd.Prefixes4+rd.Prefixes6, rd.Prefixes4, rd.Prefixes6, rd.Score())
+}
+
+// printPlan prints the starting point of the traces of qname for qtypes as
+// found in the caches of c.
+func printPlan(c *client.Client, qname string, qtypes []uint16, col func(s interface{}, c client.Color) string) {
+	zone, servers := c.Plan(qname)
+	for _, qtype := range qtypes {
+		fmt.Printf("1 - query %s %s on zone %s\n", dns.TypeToString[qtype], qname, zone)
+	}
+	var lookups []string
+	for _, s := range servers {
+		var state string
+		switch {
+		case s.HasGlue:
+			state = col("glue: "+strings.Join(s.Addrs, ","), client.ColorDarkGray)
+		case len(s.Addrs) > 0:
+			state = col("cached: "+strings.Join(s.Addrs, ","), client.ColorDarkGray)
+		default:
+			state = col("needs lookup", client.ColorYellow)
+			lookups = append(lookups, s.Name)
+		}
+		fmt.Printf("%s NS %s (%s)\n", zone, s.Name, state)
+	}
+	if len(lookups) > 0 {
+		fmt.Printf(col(";; resolve first: %s\n", client.ColorGray), strings.Join(lookups, ", "))
+	}
+	fmt.Println(col(";; next steps depend on the responses, no query sent", client.ColorGray))
+}
+
+// zoneTime is the best path time spent querying a zone.
+type zoneTime struct {
+	zone string
+	time time.Duration
+}
+
+// cnameSegments is the best path time of each name of a CNAME chain, starting
+// with the queried one. Their sum is the RTT of the recursive query.
+type cnameSegments []zoneTime
+
+// tracer returns a tracer adding the time of each step to the name being
+// resolved and starting a segment for each CNAME target followed.
+func (s *cnameSegments) tracer() client.Tracer {
+	return client.Tracer{
+		GotIntermediaryResponse: func(i int, m *dns.Msg, rs client.Responses, rtype client.ResponseType) {
+			if fr := rs.Fastest(); fr.Msg != nil {
+				(*s)[len(*s)-1].time += fr.Server.LookupRTT + fr.RTT
+			}
+		},
+		FollowingCNAME: func(domain, target string) {
+			*s = append(*s, zoneTime{zone: target})
+		},
+	}
+}
+
+// addZoneTime adds d to the time of zone in zts.
+func addZoneTime(zts []zoneTime, zone string, d time.Duration) []zoneTime {
+	for i := range zts {
+		if zts[i].zone == zone {
+			zts[i].time += d
+			return zts
+		}
+	}
+	return append(zts, zoneTime{zone, d})
+}
+
+// printZoneTimes prints the share of the best path time spent in each zone
+// with a bar of up to 20 characters.
+func printZoneTimes(zts []zoneTime, col func(s interface{}, c client.Color) string) {
+	var total time.Duration
+	width := 0
+	for _, zt := range zts {
+		total += zt.time
+		if len(zt.zone) > width {
+			width = len(zt.zone)
+		}
+	}
+	if total <= 0 {
+		return
+	}
+	fmt.Println(col(";; Time by zone:", client.ColorGray))
+	for _, zt := range zts {
+		pct := float64(zt.time) / float64(total) * 100
+		bar := strings.Repeat("#", int(pct/5+0.5))
+		fmt.Printf(col(";;   %-*s %10s %5.1f%% %s\n", client.ColorGray), width, zt.zone, zt.time, pct, bar)
+	}
+}
+
+// writeJSONFile writes the JSON form of tr to the file at path.
+func writeJSONFile(path string, tr *client.Trace) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := tr.WriteJSON(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func appendUnique(ss []string, s string) []string {
+	for _, s2 := range ss {
+		if s2 == s {
+			return ss
+		}
+	}
+	return append(ss, s)
+}
+
+// printNSComparison prints the difference between the parent and child NS
+// sets of a zone.
+func printNSComparison(nc client.NSComparison, col func(s interface{}, c client.Color) string) {
+	fmt.Println()
+	if nc.Match() {
+		fmt.Printf(col(";; %s parent and child NS sets match (%d NS)\n", client.ColorGray), nc.Zone, len(nc.Child))
+		return
+	}
+	fmt.Printf(col("! %s parent and child NS sets differ:\n", client.ColorYellow), nc.Zone)
+	for _, ns := range nc.ParentOnly {
+		fmt.Println(col("  - "+ns+" (parent only)", client.ColorRed))
+	}
+	for _, ns := range nc.ChildOnly {
+		fmt.Println(col("  + "+ns+" (child only)", client.ColorGreen))
 	}
 }
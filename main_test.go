@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/dnstrace/client"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args  []string
+		name  string
+		qtype uint16
+		err   bool
+	}{
+		{[]string{"_dmarc.example.com"}, "_dmarc.example.com.", dns.TypeTXT, false},
+		{[]string{"_25._tcp.example.com"}, "_25._tcp.example.com.", dns.TypeTLSA, false},
+		{[]string{"MX", "_25._tcp.example.com"}, "_25._tcp.example.com.", dns.TypeMX, false},
+		{[]string{"*.example.com"}, "*.example.com.", dns.TypeA, false},
+		{[]string{"*.example.com."}, "*.example.com.", dns.TypeA, false},
+		{[]string{"www.*.example.com"}, "", 0, true},
+		{[]string{"*www.example.com"}, "", 0, true},
+		{[]string{"a..example.com"}, "", 0, true},
+		{[]string{"MX"}, "", 0, true},
+		{[]string{"example.com", "example.net"}, "", 0, true},
+	}
+	for _, tt := range tests {
+		name, qtypes, err := parseArgs(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseArgs(%q) = %s %v, want an error", tt.args, name, qtypes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArgs(%q): %v", tt.args, err)
+			continue
+		}
+		if name != tt.name || len(qtypes) != 1 || qtypes[0] != tt.qtype {
+			t.Errorf("parseArgs(%q) = %s %v, want %s %s", tt.args, name, qtypes, tt.name, dns.TypeToString[tt.qtype])
+		}
+	}
+}
+
+func TestGuessType(t *testing.T) {
+	tests := []struct {
+		name string
+		want uint16
+	}{
+		{"_dmarc.example.com.", dns.TypeTXT},
+		{"_DMARC.example.com.", dns.TypeTXT},
+		{"_mta-sts.example.com.", dns.TypeTXT},
+		{"selector._domainkey.example.com.", dns.TypeTXT},
+		{"_sip._udp.example.com.", dns.TypeSRV},
+		{"_xmpp-client._tcp.example.com.", dns.TypeSRV},
+		{"_25._tcp.mail.example.com.", dns.TypeTLSA},
+		{"_443._tcp.example.com.", dns.TypeTLSA},
+		{"1.2.0.192.in-addr.arpa.", dns.TypePTR},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR},
+		{"_tcp.example.com.", dns.TypeA},
+		{"www.example.com.", dns.TypeA},
+		{".", dns.TypeA},
+	}
+	for _, tt := range tests {
+		if got := guessType(tt.name); got != tt.want {
+			t.Errorf("guessType(%s) = %s, want %s", tt.name, dns.TypeToString[got], dns.TypeToString[tt.want])
+		}
+	}
+	// An explicit type overrides the guess.
+	if _, qtypes, err := parseArgs([]string{"A", "_dmarc.example.com"}); err != nil || len(qtypes) != 1 || qtypes[0] != dns.TypeA {
+		t.Errorf("parseArgs(A _dmarc.example.com) = %v, %v, want A", qtypes, err)
+	}
+}
+
+// fixedRTT is a client.Exchanger answering with zones, by server address, in
+// the time given by rtts.
+type fixedRTT struct {
+	zones map[string]map[string][]string
+	rtts  map[string]time.Duration
+}
+
+func (e fixedRTT) ExchangeContext(_ context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	addr = strings.TrimSuffix(addr, ":53")
+	r := &dns.Msg{}
+	r.SetReply(m)
+	for _, s := range e.zones[addr][m.Question[0].Name] {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case rr.Header().Rrtype == dns.TypeNS:
+			r.Ns = append(r.Ns, rr)
+			continue
+		case rr.Header().Name != m.Question[0].Name:
+			r.Extra = append(r.Extra, rr) // glue
+			continue
+		}
+		r.Authoritative = true
+		r.Answer = append(r.Answer, rr)
+	}
+	return r, e.rtts[addr], nil
+}
+
+func TestCNAMESegments(t *testing.T) {
+	// www.example.com. -> alias.example.com. -> www.example.net.
+	e := fixedRTT{
+		zones: map[string]map[string][]string{
+			"192.0.2.1": {
+				"www.example.com.":   {"example.com. 3600 IN NS ns.example.com.", "ns.example.com. 3600 IN A 192.0.2.10"},
+				"alias.example.com.": {"example.com. 3600 IN NS ns.example.com.", "ns.example.com. 3600 IN A 192.0.2.10"},
+				"www.example.net.":   {"example.net. 3600 IN NS ns.example.net.", "ns.example.net. 3600 IN A 192.0.2.20"},
+			},
+			"192.0.2.10": {
+				"www.example.com.":   {"www.example.com. 300 IN CNAME alias.example.com."},
+				"alias.example.com.": {"alias.example.com. 300 IN CNAME www.example.net."},
+			},
+			"192.0.2.20": {
+				"www.example.net.": {"www.example.net. 300 IN A 198.51.100.1"},
+			},
+		},
+		rtts: map[string]time.Duration{
+			"192.0.2.1":  10 * time.Millisecond,
+			"192.0.2.10": 20 * time.Millisecond,
+			"192.0.2.20": 30 * time.Millisecond,
+		},
+	}
+	c := client.New(3)
+	c.Exchanger = e
+	c.SetRoots([]client.Server{{Name: "a.root.test.", HasGlue: true, Addrs: []string{"192.0.2.1"}}})
+	segments := cnameSegments{{zone: "www.example.com."}}
+	m := &dns.Msg{}
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	_, rtt, err := c.RecursiveQuery(m, segments.tracer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := cnameSegments{
+		{"www.example.com.", 30 * time.Millisecond},   // root + example.com.
+		{"alias.example.com.", 20 * time.Millisecond}, // cached example.com.
+		{"www.example.net.", 40 * time.Millisecond},   // root + example.net.
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("segments = %v, want %v", segments, want)
+	}
+	var total time.Duration
+	for i := range want {
+		if segments[i] != want[i] {
+			t.Errorf("segment %d = %v, want %v", i, segments[i], want[i])
+		}
+		total += segments[i].time
+	}
+	if rtt != 90*time.Millisecond || total != rtt {
+		t.Errorf("rtt = %s, segments total = %s, want 90ms", rtt, total)
+	}
+}
+
+func TestCountAddrs(t *testing.T) {
+	servers := []client.Server{
+		{Name: "ns1.example.", Addrs: []string{"192.0.2.1", "2001:db8::1"}},
+		{Name: "ns2.example.", Addrs: []string{"192.0.2.2"}},
+		{Name: "ns3.example."},
+	}
+	for family, want := range map[int]int{0: 3, 4: 2, 6: 1} {
+		if n := countAddrs(servers, family); n != want {
+			t.Errorf("countAddrs(family %d) = %d, want %d", family, n, want)
+		}
+	}
+}
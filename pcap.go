@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/dnstrace/client"
+)
+
+const (
+	pcapLinkTypeRaw = 101 // raw IPv4 or IPv6 packets
+	pcapSnapLen     = 65535
+	pcapLocalPort   = 50000 // first source port of synthetic packets
+)
+
+var (
+	pcapLocal4 = net.ParseIP("192.0.2.1").To4()
+	pcapLocal6 = net.ParseIP("2001:db8::1")
+)
+
+type pcapPacket struct {
+	ts   time.Time
+	data []byte
+}
+
+// writePcapFile writes the exchanges of tr as a pcap file at path.
+func writePcapFile(path string, q *dns.Msg, tr *client.Trace) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writePcap(f, q, tr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writePcap writes the exchanges of tr as a pcap stream readable by Wireshark.
+// Packets are rebuilt from the messages with synthetic IP and UDP headers: the
+// local address is a documentation address, each exchange gets its own source
+// port and the query of each step is q with the question of the step.
+func writePcap(w io.Writer, q *dns.Msg, tr *client.Trace) error {
+	var pkts []pcapPacket
+	port := uint16(pcapLocalPort)
+	for _, s := range tr.Steps {
+		sq := q.Copy()
+		sq.Question[0] = s.Question
+		query, err := sq.Pack()
+		if err != nil {
+			return err
+		}
+		for _, r := range s.Responses {
+			remote := net.ParseIP(r.Addr)
+			if remote == nil {
+				continue
+			}
+			local := pcapLocal6
+			if remote.To4() != nil {
+				local, remote = pcapLocal4, remote.To4()
+			}
+			pkts = append(pkts, pcapPacket{r.Start, udpPacket(local, remote, port, 53, query)})
+			if r.Msg != nil {
+				resp, err := r.Msg.Pack()
+				if err != nil {
+					return err
+				}
+				pkts = append(pkts, pcapPacket{r.Start.Add(r.RTT), udpPacket(remote, local, 53, port, resp)})
+			}
+			port++
+		}
+	}
+	sort.SliceStable(pkts, func(i, j int) bool {
+		return pkts[i].ts.Before(pkts[j].ts)
+	})
+
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	for _, p := range pkts {
+		rec := make([]byte, 16, 16+len(p.data))
+		binary.LittleEndian.PutUint32(rec[0:], uint32(p.ts.Unix()))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(p.ts.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(p.data)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(p.data)))
+		if _, err := w.Write(append(rec, p.data...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// udpPacket returns an IPv4 or IPv6 packet, depending on the length of src,
+// carrying payload in a UDP datagram.
+func udpPacket(src, dst net.IP, sport, dport uint16, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], sport)
+	binary.BigEndian.PutUint16(udp[2:], dport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	if len(src) == net.IPv4len {
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45 // version 4, 5 words header
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64   // TTL
+		ip[9] = 17   // UDP
+		copy(ip[12:], src)
+		copy(ip[16:], dst)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+		// The UDP checksum is optional over IPv4 and left to zero.
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17 // UDP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], src)
+	copy(ip[24:], dst)
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:], src)
+	copy(pseudo[16:], dst)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(udp)))
+	pseudo[39] = 17
+	sum := ^checksum(checksum(0, pseudo), udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(ip, udp...)
+}
+
+// checksum adds b to the ones' complement sum.
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+	"github.com/rs/dnstrace/client"
+)
+
+const replHelp = `Commands:
+  [qtype...] <domain>  trace domain (A by default)
+  @<server>            send the next queries to server only, without tracing
+  @                    trace from the root servers again
+  roots [address...]   show or set the root servers
+  clearcache           forget cached delegations and addresses
+  help                 show this help
+  quit                 exit`
+
+// repl reads commands from r until EOF or quit. Caches of c are kept between
+// queries. An interrupt cancels the running query only.
+func repl(c *client.Client, r io.Reader, o options) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	var direct *client.Server
+	sc := bufio.NewScanner(r)
+	for {
+		prompt := "> "
+		if direct != nil {
+			prompt = "@" + direct.Name + "> "
+		}
+		fmt.Print(o.col(prompt, client.ColorBold))
+		if !sc.Scan() {
+			fmt.Println()
+			return
+		}
+		args := strings.Fields(sc.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch cmd := args[0]; {
+		case cmd == "quit" || cmd == "exit":
+			return
+		case cmd == "help":
+			fmt.Println(replHelp)
+		case cmd == "clearcache":
+			c.Reset()
+		case cmd == "roots":
+			replRoots(c, args[1:], o)
+		case cmd == "@":
+			direct = nil
+		case strings.HasPrefix(cmd, "@"):
+			s, err := replServer(c, cmd[1:])
+			if err != nil {
+				fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+				continue
+			}
+			direct = &s
+		default:
+			qname, qtypes, err := parseArgs(args)
+			if err != nil {
+				fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+				continue
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-sig:
+					cancel()
+				case <-done:
+				}
+			}()
+			replQuery(ctx, c, direct, qname, qtypes, o)
+			close(done)
+			cancel()
+		}
+	}
+}
+
+// replQuery traces qname for qtypes, or queries direct only if not nil.
+func replQuery(ctx context.Context, c *client.Client, direct *client.Server, qname string, qtypes []uint16, o options) {
+	for i, qtype := range qtypes {
+		if len(qtypes) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Println(o.col(fmt.Sprintf(";;; %s %s", dns.TypeToString[qtype], qname), client.ColorBold))
+			fmt.Println()
+		}
+		m := newQuery(qname, qtype, o)
+		var err error
+		if direct != nil {
+			err = queryServer(ctx, c, *direct, m, o)
+		} else {
+			err = trace(ctx, c, m, o)
+		}
+		if ctx.Err() != nil {
+			fmt.Println(o.col("\n(interrupted)", client.ColorYellow))
+			return
+		}
+		if err != nil && !errors.Is(err, errUnexpected) {
+			fmt.Printf(o.col("*** error: %v\n", client.ColorRed), err)
+		}
+	}
+}
+
+// queryServer sends m to s only and prints its response.
+func queryServer(ctx context.Context, c *client.Client, s client.Server, m *dns.Msg, o options) error {
+	rs := c.ParallelQueryContext(ctx, m, []client.Server{s})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	client.NewTextTracer(os.Stdout, o.textOptions()).GotIntermediaryResponse(1, m, rs, client.ResponseTypeFinal)
+	fr := rs.Fastest()
+	if fr.Msg == nil {
+		if len(rs) > 0 {
+			return rs[0].Err
+		}
+		return errors.New("no response")
+	}
+	if fr.Msg.Opcode != m.Opcode {
+		fmt.Printf(o.col("! response opcode %s differs from the query opcode %s\n", client.ColorYellow),
+			dns.OpcodeToString[fr.Msg.Opcode], dns.OpcodeToString[m.Opcode])
+	}
+	fmt.Println()
+	writeAnswer(os.Stdout, fr.Msg, fr.RTT, o.format, o.verbose)
+	return nil
+}
+
+// replServer returns the server at host, an address or a name to resolve.
+func replServer(c *client.Client, host string) (client.Server, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return client.Server{Name: ip.String(), Addrs: []string{ip.String()}}, nil
+	}
+	s := client.Server{Name: dns.Fqdn(host)}
+	if _, ok := dns.IsDomainName(s.Name); !ok {
+		return s, fmt.Errorf("invalid server %q", host)
+	}
+	if s.Addrs, s.LookupRTT = c.LookupHost(s.Name); len(s.Addrs) == 0 {
+		return s, fmt.Errorf("cannot resolve %s", s.Name)
+	}
+	return s, nil
+}
+
+// replRoots prints the root servers of c, or sets them to addrs if any.
+func replRoots(c *client.Client, addrs []string, o options) {
+	if len(addrs) > 0 {
+		var rs []client.Server
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				fmt.Printf(o.col("*** error: invalid root %q: expected an IP address\n", client.ColorRed), addr)
+				return
+			}
+			rs = append(rs, client.Server{Name: ip.String(), HasGlue: true, Addrs: []string{ip.String()}})
+		}
+		c.SetRoots(rs)
+	}
+	zone, servers := c.Plan(".")
+	for _, s := range servers {
+		fmt.Printf("%s NS %s (%s)\n", zone, s.Name, strings.Join(s.Addrs, ","))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/dnstrace/client"
+)
+
+// serve exposes the traces of c over HTTP on addr until ctx is done:
+// GET /trace?name=<domain>[&type=<qtype>] returns the JSON trace of the
+// query. All the requests share c and its caches, and each trace is bounded
+// by timeout.
+func serve(ctx context.Context, c *client.Client, addr string, timeout time.Duration, o options) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trace", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name := strings.TrimSpace(req.URL.Query().Get("name"))
+		if name == "" {
+			httpError(w, http.StatusBadRequest, "missing name parameter")
+			return
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("invalid name %q", name))
+			return
+		}
+		name = dns.Fqdn(name)
+		qtype := guessType(name)
+		if t := req.URL.Query().Get("type"); t != "" {
+			var found bool
+			if qtype, found = dns.StringToType[strings.ToUpper(t)]; !found {
+				httpError(w, http.StatusBadRequest, fmt.Sprintf("invalid type %q", t))
+				return
+			}
+		}
+		tctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		rec := c.TraceQuery(tctx, newQuery(name, qtype, o))
+		if o.jsonLocal {
+			rec.TimeLocation = time.Local
+		}
+		if o.jsonMs {
+			rec.TimeLayout = client.RFC3339Milli
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if errors.Is(rec.Err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+		_ = rec.WriteJSON(w)
+	})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdown)
+	}()
+	fmt.Fprintf(os.Stderr, "serving traces on http://%s/trace\n", addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// httpError writes msg as a JSON error with the given status code.
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/dnstrace/client"
+)
+
+// watch resolves qname for qtypes every interval with empty caches, or with
+// caches expiring per TTL with -honor-ttl, and prints a timestamped line each
+// time the answers change, until ctx is done.
+func watch(ctx context.Context, c *client.Client, qname string, qtypes []uint16, interval time.Duration, o options) {
+	prev := map[uint16]string{}
+	fmt.Printf(o.col(";; watching %s every %s\n", client.ColorGray), qname, interval)
+	for _, qtype := range qtypes {
+		prev[qtype] = queryAnswer(ctx, c, qname, qtype, o)
+		fmt.Printf("%s %s %s: %s\n", time.Now().Format(time.RFC3339), dns.TypeToString[qtype], qname, prev[qtype])
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if !o.honorTTL {
+			c.Reset()
+		}
+		for _, qtype := range qtypes {
+			cur := queryAnswer(ctx, c, qname, qtype, o)
+			if ctx.Err() != nil {
+				return
+			}
+			if cur != prev[qtype] {
+				fmt.Printf("%s %s %s changed: %s -> %s\n", time.Now().Format(time.RFC3339),
+					dns.TypeToString[qtype], qname, o.col(prev[qtype], client.ColorRed), o.col(cur, client.ColorGreen))
+				prev[qtype] = cur
+			}
+		}
+	}
+}
+
+// queryAnswer returns the answerSummary of the query of qname and qtype.
+func queryAnswer(ctx context.Context, c *client.Client, qname string, qtype uint16, o options) string {
+	r, _, err := c.RecursiveQueryContext(ctx, newQuery(qname, qtype, o), client.Tracer{})
+	return answerSummary(r, err)
+}
+
+// answerSummary returns a summary of the answer r or of err that does not
+// depend on record order or TTLs.
+func answerSummary(r *dns.Msg, err error) string {
+	switch {
+	case err != nil:
+		return "error: " + err.Error()
+	case r.Rcode != dns.RcodeSuccess:
+		return dns.RcodeToString[r.Rcode]
+	}
+	var rrs []string
+	for _, rr := range r.Answer {
+		rrs = append(rrs, dns.TypeToString[rr.Header().Rrtype]+" "+rdata(rr))
+	}
+	if len(rrs) == 0 {
+		return "NODATA"
+	}
+	sort.Strings(rrs)
+	return strings.Join(rrs, ", ")
+}
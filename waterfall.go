@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/rs/dnstrace/client"
+)
+
+// writeWaterfall writes a CSV line per exchange with its start offset and
+// duration relative to start, suitable for timeline visualisation tools.
+func writeWaterfall(w io.Writer, start time.Time, steps []client.Responses) {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"step", "start_ms", "duration_ms", "server", "addr", "zone", "error"})
+	for i, rs := range steps {
+		for _, r := range rs {
+			var errStr string
+			if r.Err != nil {
+				errStr = r.Err.Error()
+			}
+			_ = cw.Write([]string{
+				strconv.Itoa(i + 1),
+				ms(r.Start.Sub(start)),
+				ms(r.RTT),
+				r.Server.Name,
+				r.Addr,
+				r.Zone,
+				errStr,
+			})
+		}
+	}
+	cw.Flush()
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}